@@ -0,0 +1,3 @@
+module github.com/alpe/messaging_spike
+
+go 1.24
@@ -0,0 +1,203 @@
+package messaging_spike
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"time"
+)
+
+var ErrDuplicateMessage = errors.New("duplicate message")
+
+// default window of the duplicate detection of a SourceProcessConsumer
+const defaultIdempotencyLimit = 10000
+
+type idempotencyEntry struct {
+	ID string    `json:"id"`
+	At time.Time `json:"at"`
+}
+
+// IdempotencyLog detects messages received before by their ID. The IDs are kept exactly in a
+// window bounded by count and age. IDs leaving the window can be kept in a Bloom filter: a
+// match there is confirmed by an exact lookup, or taken as duplicate without one.
+type IdempotencyLog struct {
+	limit  int           // IDs kept exactly; unbounded when 0
+	ttl    time.Duration // of IDs kept exactly; forever when 0
+	now    func() time.Time
+	window *list.List // of idempotencyEntry, oldest first
+	ids    map[string]*list.Element
+	bloom  *bloomFilter                  // IDs evicted from the window, when enabled
+	lookup func(id string) (bool, error) // exact fallback for matches of the Bloom filter
+}
+
+func NewIdempotencyLog(limit int, ttl time.Duration) *IdempotencyLog {
+	return &IdempotencyLog{
+		limit:  limit,
+		ttl:    ttl,
+		now:    time.Now,
+		window: list.New(),
+		ids:    make(map[string]*list.Element),
+	}
+}
+
+// WithBloomFilter keeps evicted IDs in a Bloom filter of m bits and k hash functions. The
+// lookup confirms a match exactly, for example with the persisted message log; it can be nil.
+func (l *IdempotencyLog) WithBloomFilter(m, k uint, lookup func(id string) (bool, error)) *IdempotencyLog {
+	l.bloom = newBloomFilter(m, k)
+	l.lookup = lookup
+	return l
+}
+
+// WithClock replaces time.Now for the age of the IDs kept exactly.
+func (l *IdempotencyLog) WithClock(now func() time.Time) *IdempotencyLog {
+	l.now = now
+	return l
+}
+
+// Add records the ID. It returns ErrDuplicateMessage when the ID was added before.
+func (l *IdempotencyLog) Add(id string) error {
+	seen, err := l.Seen(id)
+	if err != nil {
+		return err
+	}
+	if seen {
+		return fmt.Errorf("%w: %q", ErrDuplicateMessage, id)
+	}
+	l.record(id)
+	return nil
+}
+
+// Seen is true when the ID was added before.
+func (l *IdempotencyLog) Seen(id string) (bool, error) {
+	l.evict()
+	if _, ok := l.ids[id]; ok {
+		return true, nil
+	}
+	if l.bloom == nil || !l.bloom.mayContain(id) {
+		return false, nil
+	}
+	if l.lookup == nil {
+		return true, nil
+	}
+	return l.lookup(id)
+}
+
+// record adds an ID not seen before.
+func (l *IdempotencyLog) record(id string) {
+	l.ids[id] = l.window.PushBack(idempotencyEntry{ID: id, At: l.now()})
+	l.evict()
+}
+
+// Len returns the number of IDs kept exactly.
+func (l *IdempotencyLog) Len() int {
+	return l.window.Len()
+}
+
+func (l *IdempotencyLog) evict() {
+	for e := l.window.Front(); e != nil; e = l.window.Front() {
+		entry := e.Value.(idempotencyEntry)
+		expired := l.ttl > 0 && l.now().Sub(entry.At) >= l.ttl
+		if !expired && (l.limit <= 0 || l.window.Len() <= l.limit) {
+			return
+		}
+		l.window.Remove(e)
+		delete(l.ids, entry.ID)
+		if l.bloom != nil {
+			l.bloom.add(entry.ID)
+		}
+	}
+}
+
+// persisted form of an IdempotencyLog
+type idempotencyLogState struct {
+	Window []idempotencyEntry `json:"window"`
+	Bloom  []uint64           `json:"bloom,omitempty"`
+	Hashes uint               `json:"hashes,omitempty"`
+}
+
+// Save writes the window and the Bloom filter, so that duplicates are detected across restarts.
+func (l *IdempotencyLog) Save(w io.Writer) error {
+	s := idempotencyLogState{Window: make([]idempotencyEntry, 0, l.window.Len())}
+	for e := l.window.Front(); e != nil; e = e.Next() {
+		s.Window = append(s.Window, e.Value.(idempotencyEntry))
+	}
+	if l.bloom != nil {
+		s.Bloom, s.Hashes = l.bloom.bits, l.bloom.k
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// Load replaces the content with a saved one. The limits of the log apply.
+func (l *IdempotencyLog) Load(r io.Reader) error {
+	var s idempotencyLogState
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if len(s.Bloom) > 0 {
+		if l.bloom == nil || len(l.bloom.bits) != len(s.Bloom) || l.bloom.k != s.Hashes {
+			return fmt.Errorf("bloom filter of %d bits and %d hashes does not match", len(s.Bloom)*64, s.Hashes)
+		}
+		copy(l.bloom.bits, s.Bloom)
+	}
+	l.window.Init()
+	l.ids = make(map[string]*list.Element, len(s.Window))
+	for _, e := range s.Window {
+		l.ids[e.ID] = l.window.PushBack(e)
+	}
+	l.evict()
+	return nil
+}
+
+type bloomFilter struct {
+	bits []uint64
+	k    uint
+}
+
+func newBloomFilter(m, k uint) *bloomFilter {
+	if k == 0 {
+		k = 1
+	}
+	words := (m + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words), k: k}
+}
+
+// locations by double hashing of the halves of a 64 bit FNV hash, mixed like murmur3 as
+// short IDs differ in few bits only
+func (b *bloomFilter) locations(id string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	m := uint64(len(b.bits) * 64)
+	locations := make([]uint64, b.k)
+	for i := range locations {
+		locations[i] = (h1 + uint64(i)*h2) % m
+	}
+	return locations
+}
+
+func (b *bloomFilter) add(id string) {
+	for _, n := range b.locations(id) {
+		b.bits[n/64] |= 1 << (n % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(id string) bool {
+	for _, n := range b.locations(id) {
+		if b.bits[n/64]&(1<<(n%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package messaging_spike
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyLogWindow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	specs := map[string]struct {
+		limit     int
+		ttl       time.Duration
+		duplicate []bool // of c, b and a
+	}{
+		"unbounded": {0, 0, []bool{true, true, true}},
+		"by count":  {2, 0, []bool{true, true, false}},
+		"by age":    {0, time.Minute, []bool{true, false, false}},
+	}
+	for name, spec := range specs {
+		// given
+		l := NewIdempotencyLog(spec.limit, spec.ttl).WithClock(fixedNow(&now))
+		for _, id := range []string{"a", "b", "c"} {
+			if err := l.Add(id); err != nil {
+				t.Fatalf("%s: unexpected error %s", name, err)
+			}
+			now = now.Add(30 * time.Second)
+		}
+		// when
+		for i, id := range []string{"c", "b", "a"} {
+			exp := spec.duplicate[i]
+			err := l.Add(id)
+			// then
+			if got := errors.Is(err, ErrDuplicateMessage); got != exp {
+				t.Errorf("%s: %s: expected %v but got %v", name, id, exp, err)
+			}
+		}
+	}
+}
+
+func TestIdempotencyLogBloomFilter(t *testing.T) {
+	// given IDs evicted from a window of one
+	l := NewIdempotencyLog(1, 0).WithBloomFilter(1024, 3, nil)
+	for i := 0; i < 10; i++ {
+		if err := l.Add(fmt.Sprint(i)); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if got, exp := l.Len(), 1; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	// when
+	err := l.Add("0")
+	// then
+	if !errors.Is(err, ErrDuplicateMessage) {
+		t.Errorf("expected %v but got %v", ErrDuplicateMessage, err)
+	}
+	// and matches are confirmed by the exact lookup
+	var looked []string
+	l.lookup = func(id string) (bool, error) {
+		looked = append(looked, id)
+		return false, nil
+	}
+	if err := l.Add("1"); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if got, exp := fmt.Sprint(looked), "[1]"; got != exp {
+		t.Errorf("expected %s but got %s", exp, got)
+	}
+}
+
+func TestIdempotencyLogSurvivesRestart(t *testing.T) {
+	// given
+	l := NewIdempotencyLog(2, 0).WithBloomFilter(1024, 3, nil)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := l.Add(id); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := l.Save(&buf); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	r := NewIdempotencyLog(2, 0).WithBloomFilter(1024, 3, nil)
+	if err := r.Load(&buf); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	for _, id := range []string{"a", "b", "c"} {
+		if err := r.Add(id); !errors.Is(err, ErrDuplicateMessage) {
+			t.Errorf("%s: expected %v but got %v", id, ErrDuplicateMessage, err)
+		}
+	}
+	// and another Bloom filter is rejected
+	if err := l.Save(&buf); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := NewIdempotencyLog(2, 0).Load(&buf); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestConsumerDetectsDuplicatesByMessageID(t *testing.T) {
+	// given
+	c := NewManualStartConsumer(A)
+	if err := c.DoProcessing(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	clock := NewVectorClock(B).Inc()
+	// when the same state is sent by another message
+	for _, e := range []*ExternalEventMessage{
+		{id: "1", vectorClock: clock, newState: "b1"},
+		{id: "2", vectorClock: clock.Inc(), newState: "b1"},
+	} {
+		if err := c.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// then the same message again is a duplicate
+	err := c.OnEvent(&ExternalEventMessage{id: "2", vectorClock: clock.Inc().Inc(), newState: "b2"})
+	if !errors.Is(err, ErrDuplicateMessage) {
+		t.Errorf("expected %v but got %v", ErrDuplicateMessage, err)
+	}
+}
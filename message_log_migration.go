@@ -0,0 +1,141 @@
+package messaging_spike
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MigrationReport summarizes a bulk migration of a message log.
+type MigrationReport struct {
+	Counts   map[string]map[uint]int // migrated messages by type and original version
+	Failures []MigrationFailure
+}
+
+func newMigrationReport() MigrationReport {
+	return MigrationReport{Counts: make(map[string]map[uint]int)}
+}
+
+func (r *MigrationReport) count(m VersionableMessage) {
+	if _, ok := r.Counts[m.Type()]; !ok {
+		r.Counts[m.Type()] = make(map[uint]int)
+	}
+	r.Counts[m.Type()][m.Version()]++
+}
+
+func (r MigrationReport) String() string {
+	types := make([]string, 0, len(r.Counts))
+	for t := range r.Counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	var b strings.Builder
+	for _, t := range types {
+		versions := make([]uint, 0, len(r.Counts[t]))
+		for v := range r.Counts[t] {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+		for _, v := range versions {
+			fmt.Fprintf(&b, "%s v%d: %d\n", t, v, r.Counts[t][v])
+		}
+	}
+	fmt.Fprintf(&b, "failures: %d\n", len(r.Failures))
+	for _, f := range r.Failures {
+		fmt.Fprintf(&b, "  %s\n", f)
+	}
+	return b.String()
+}
+
+// MigrationFailure is a message of the log that could not be migrated.
+type MigrationFailure struct {
+	Line int
+	Err  error
+}
+
+func (f MigrationFailure) Error() string {
+	return fmt.Sprintf("line %d: %v", f.Line, f.Err)
+}
+
+// MigrateLog copies a log of JSON encoded messages, one per line, and upgrades every message
+// to the latest version of its type with the same migrations a MessageUpgradeDecorator uses.
+// This moves the upgrade cost from every replay to a single batch run. Messages that fail
+// are copied unchanged and reported, so that no message is lost; the returned error is for
+// I/O failures only.
+func MigrateLog(in io.Reader, out io.Writer, r *MigrationRegistry) (MigrationReport, error) {
+	report := newMigrationReport()
+	if err := r.Validate(); err != nil {
+		return report, err
+	}
+	s := bufio.NewScanner(in)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	w := bufio.NewWriter(out)
+	for line := 1; s.Scan(); line++ {
+		data := bytes.TrimSpace(s.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		b, m, err := upgradeEncoded(r, data)
+		if err != nil {
+			report.Failures = append(report.Failures, MigrationFailure{Line: line, Err: err})
+			b = data
+		} else {
+			report.count(m)
+		}
+		if _, err := w.Write(b); err != nil {
+			return report, err
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return report, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return report, err
+	}
+	return report, w.Flush()
+}
+
+// MigrateLogFile runs MigrateLog from one file into a new one. The target is only created
+// when every message of the source log was migrated, so that it never mixes versions; the
+// report lists the messages that failed otherwise.
+func MigrateLogFile(src, dst string, r *MigrationRegistry) (report MigrationReport, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return newMigrationReport(), err
+	}
+	defer func() { err = errors.Join(err, in.Close()) }()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return newMigrationReport(), err
+	}
+	report, err = MigrateLog(in, out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && len(report.Failures) != 0 {
+		err = fmt.Errorf("%d messages not migrated, first in %w", len(report.Failures), report.Failures[0])
+	}
+	if err != nil {
+		return report, errors.Join(err, os.Remove(tmp))
+	}
+	return report, os.Rename(tmp, dst)
+}
+
+func upgradeEncoded(r *MigrationRegistry, data []byte) ([]byte, VersionableMessage, error) {
+	m, err := r.Decode(data)
+	if err != nil {
+		return nil, m, err
+	}
+	v, c, err := r.Upgrade(m.Type(), m.Version(), m.Content())
+	if err != nil {
+		return nil, m, err
+	}
+	b, err := r.Encode(VersionableMessage{id: m.ID(), messageType: m.Type(), version: v, content: c})
+	return b, m, err
+}
@@ -0,0 +1,160 @@
+package messaging_spike
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const storedMessageLog = `{"type":"StateUpdated","version":1,"payload":{"value":"first"}}
+{"type":"StateReset","version":1}
+{"type":"StateUpdated","version":2,"payload":{"foo":"myFoo","value":"second"}}
+
+{"type":"StateUpdated","version":1,"payload":{"text":"broken"}}
+{"type":"StateUpdated","version":3,"payload":{"foo":"anotherFoo","bar":"anotherBar","value":"latest"}}
+{"type":"Unknown","version":1,"payload":{}}
+{"type":"StateUpdated","version":1,"payload":{"value":"again"}}
+`
+
+func TestMigrateLogUpgradesEveryMessage(t *testing.T) {
+	// given
+	var out bytes.Buffer
+
+	// when
+	report, err := MigrateLog(strings.NewReader(storedMessageLog), &out, DefaultMigrations())
+
+	// then
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp := []string{
+		`{"type":"StateUpdated","version":3,"payload":{"bar":"defaultBar","foo":"defaultFoo","value":"first"}}`,
+		`{"type":"StateReset","version":2,"payload":{"value":"init"}}`,
+		`{"type":"StateUpdated","version":3,"payload":{"bar":"defaultBar","foo":"myFoo","value":"second"}}`,
+		`{"type":"StateUpdated","version":1,"payload":{"text":"broken"}}`,
+		`{"type":"StateUpdated","version":3,"payload":{"bar":"anotherBar","foo":"anotherFoo","value":"latest"}}`,
+		`{"type":"Unknown","version":1,"payload":{}}`,
+		`{"type":"StateUpdated","version":3,"payload":{"bar":"defaultBar","foo":"defaultFoo","value":"again"}}`,
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+	expCounts := map[string]map[uint]int{
+		stateUpdatedType: {v1: 2, v2: 1, vLatest: 1},
+		stateResetType:   {resetV1: 1},
+	}
+	if got := report.Counts; !reflect.DeepEqual(got, expCounts) {
+		t.Errorf("expected %v but got %v", expCounts, got)
+	}
+	var failedLines []int
+	for _, f := range report.Failures {
+		failedLines = append(failedLines, f.Line)
+	}
+	if got, exp := failedLines, []int{5, 7}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected failures in lines %v but got %v", exp, got)
+	}
+}
+
+func TestMigrateLogKeepsEveryMessage(t *testing.T) {
+	// when
+	var out bytes.Buffer
+	if _, err := MigrateLog(strings.NewReader(storedMessageLog), &out, DefaultMigrations()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// then every input message is in the output at its position
+	r := DefaultMigrations()
+	var messages []string
+	for _, l := range strings.Split(storedMessageLog, "\n") {
+		if l != "" {
+			messages = append(messages, l)
+		}
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(got) != len(messages) {
+		t.Fatalf("expected %d messages but got %d", len(messages), len(got))
+	}
+	for i, l := range messages {
+		exp, _, err := upgradeEncoded(r, []byte(l))
+		if err != nil {
+			exp = []byte(l) // copied unchanged
+		}
+		if got[i] != string(exp) {
+			t.Errorf("expected %q but got %q", exp, got[i])
+		}
+	}
+}
+
+// migratableMessageLog is the stored message log without the messages that fail.
+const migratableMessageLog = `{"type":"StateUpdated","version":1,"payload":{"value":"first"}}
+{"type":"StateReset","version":1}
+{"type":"StateUpdated","version":2,"payload":{"foo":"myFoo","value":"second"}}
+{"type":"StateUpdated","version":3,"payload":{"foo":"anotherFoo","bar":"anotherBar","value":"latest"}}
+{"type":"StateUpdated","version":1,"payload":{"value":"again"}}
+`
+
+func TestMigrateLogFileWritesNewLog(t *testing.T) {
+	// given
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "messages.log"), filepath.Join(dir, "messages.migrated.log")
+	if err := os.WriteFile(src, []byte(migratableMessageLog), 0o600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	if _, err := MigrateLogFile(src, dst, DefaultMigrations()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	b, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// and the migrated log is stable when migrated again
+	again, err := MigrateLog(bytes.NewReader(b), &bytes.Buffer{}, DefaultMigrations())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, exp := again.Counts, map[string]map[uint]int{stateUpdatedType: {vLatest: 4}, stateResetType: {resetVLatest: 1}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+	if got, exp := len(again.Failures), 0; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestMigrateLogFileKeepsNoTargetOnFailures(t *testing.T) {
+	// given
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "messages.log"), filepath.Join(dir, "messages.migrated.log")
+	if err := os.WriteFile(src, []byte(storedMessageLog), 0o600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// when
+	report, err := MigrateLogFile(src, dst, DefaultMigrations())
+	// then
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got, exp := len(report.Failures), 2; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+	for _, path := range []string{dst, dst + ".tmp"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected no file %s but got: %v", path, err)
+		}
+	}
+}
+
+func TestMigrateLogFileKeepsNoTargetOnError(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "messages.migrated.log")
+	if _, err := MigrateLogFile(filepath.Join(t.TempDir(), "missing.log"), dst, DefaultMigrations()); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("expected no target file but got: %v", err)
+	}
+}
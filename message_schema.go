@@ -0,0 +1,258 @@
+package messaging_spike
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Document is a message payload as decoded from JSON, without a Go type.
+type Document map[string]interface{}
+
+func (d Document) copy() Document {
+	c := make(Document, len(d))
+	for k, v := range d {
+		c[k] = v
+	}
+	return c
+}
+
+// String returns a string field or an error when the field is missing or not a string.
+func (d Document) String(name string) (string, error) {
+	v, ok := d[name]
+	if !ok {
+		return "", fmt.Errorf("missing field %q", name)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %q is not a string but %T", name, v)
+	}
+	return s, nil
+}
+
+// Schema describes the JSON document of one version of a message type.
+type Schema struct {
+	Required []string                               // fields every document must contain
+	Decode   func(Document) (MessagePayload, error) // typed payload for a document; the raw document is kept when nil
+	Encode   func(MessagePayload) (Document, error) // inverse of Decode
+}
+
+func (s Schema) validate(d Document) error {
+	for _, f := range s.Required {
+		if _, ok := d[f]; !ok {
+			return fmt.Errorf("missing required field %q", f)
+		}
+	}
+	return nil
+}
+
+// persisted form of a VersionableMessage
+type messageEnvelope struct {
+	ID      string   `json:"id,omitempty"`
+	Type    string   `json:"type"`
+	Version uint     `json:"version"`
+	Payload Document `json:"payload"`
+}
+
+// RegisterSchema adds the schema of one version of a message type.
+func (r *MigrationRegistry) RegisterSchema(messageType string, version uint, s Schema) *MigrationRegistry {
+	k := migrationKey{messageType: messageType, version: version}
+	if _, exists := r.schemas[k]; exists {
+		r.errs = append(r.errs, fmt.Errorf("duplicate schema for %q version %d", messageType, version))
+		return r
+	}
+	r.schemas[k] = s
+	return r
+}
+
+// Decode reads a VersionableMessage from JSON. The payload is validated against the schema of
+// its version and converted into a typed payload when the schema provides a decoder.
+func (r *MigrationRegistry) Decode(data []byte) (VersionableMessage, error) {
+	var e messageEnvelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return VersionableMessage{}, err
+	}
+	s, ok := r.schemas[migrationKey{e.Type, e.Version}]
+	if !ok {
+		return VersionableMessage{}, fmt.Errorf("no schema for %q version %d", e.Type, e.Version)
+	}
+	if e.Payload == nil {
+		e.Payload = Document{}
+	}
+	if err := s.validate(e.Payload); err != nil {
+		return VersionableMessage{}, fmt.Errorf("invalid %q version %d: %v", e.Type, e.Version, err)
+	}
+	var content MessagePayload = e.Payload
+	if s.Decode != nil {
+		var err error
+		if content, err = s.Decode(e.Payload); err != nil {
+			return VersionableMessage{}, fmt.Errorf("invalid %q version %d: %v", e.Type, e.Version, err)
+		}
+	}
+	return VersionableMessage{id: e.ID, messageType: e.Type, version: e.Version, content: content}, nil
+}
+
+// Encode writes a VersionableMessage as JSON in the schema of its version.
+func (r *MigrationRegistry) Encode(m VersionableMessage) ([]byte, error) {
+	s, ok := r.schemas[migrationKey{m.Type(), m.Version()}]
+	if !ok {
+		return nil, fmt.Errorf("no schema for %q version %d", m.Type(), m.Version())
+	}
+	d, ok := m.Content().(Document)
+	if !ok {
+		if s.Encode == nil {
+			return nil, fmt.Errorf("can not encode %T for %q version %d", m.Content(), m.Type(), m.Version())
+		}
+		var err error
+		if d, err = s.Encode(m.Content()); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.validate(d); err != nil {
+		return nil, fmt.Errorf("invalid %q version %d: %v", m.Type(), m.Version(), err)
+	}
+	return json.Marshal(messageEnvelope{ID: m.ID(), Type: m.Type(), Version: m.Version(), Payload: d})
+}
+
+// DocumentTransform modifies a raw document as part of a migration.
+type DocumentTransform func(Document) error
+
+// MigrateDocument builds a migration that applies the transforms to a copy of a raw document.
+func MigrateDocument(transforms ...DocumentTransform) TypedMigration {
+	return Migrate(func(d Document) (Document, error) {
+		d = d.copy()
+		for _, t := range transforms {
+			if err := t(d); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	})
+}
+
+// AddField introduces a new field. It fails when the field exists already.
+func AddField(name string, value interface{}) DocumentTransform {
+	return func(d Document) error {
+		if _, exists := d[name]; exists {
+			return fmt.Errorf("field %q exists already", name)
+		}
+		d[name] = value
+		return nil
+	}
+}
+
+// RenameField moves the value of a field to a new name. Missing fields are ignored.
+func RenameField(from, to string) DocumentTransform {
+	return func(d Document) error {
+		v, ok := d[from]
+		if !ok {
+			return nil
+		}
+		if _, exists := d[to]; exists {
+			return fmt.Errorf("can not rename %q: field %q exists already", from, to)
+		}
+		delete(d, from)
+		d[to] = v
+		return nil
+	}
+}
+
+// DefaultValue sets a field that is missing or null.
+func DefaultValue(name string, value interface{}) DocumentTransform {
+	return func(d Document) error {
+		if v, ok := d[name]; !ok || v == nil {
+			d[name] = value
+		}
+		return nil
+	}
+}
+
+// schemas of the default message types
+
+var v1Schema = Schema{
+	Required: []string{"value"},
+	Decode: func(d Document) (MessagePayload, error) {
+		v, err := d.String("value")
+		return V1Payload(v), err
+	},
+	Encode: func(p MessagePayload) (Document, error) {
+		v, ok := p.(V1Payload)
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %T for version %d", p, v1)
+		}
+		return Document{"value": string(v)}, nil
+	},
+}
+
+var v2Schema = Schema{
+	Required: []string{"value"},
+	Decode: func(d Document) (MessagePayload, error) {
+		content := make(map[string]string, len(d))
+		for k := range d {
+			v, err := d.String(k)
+			if err != nil {
+				return nil, err
+			}
+			content[k] = v
+		}
+		return V2Payload{content: content}, nil
+	},
+	Encode: func(p MessagePayload) (Document, error) {
+		v, ok := p.(V2Payload)
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %T for version %d", p, v2)
+		}
+		d := make(Document, len(v.content))
+		for k, s := range v.content {
+			d[k] = s
+		}
+		return d, nil
+	},
+}
+
+var vLatestSchema = Schema{
+	Required: []string{"foo", "bar", "value"},
+	Decode: func(d Document) (MessagePayload, error) {
+		var p LatestPayload
+		var err error
+		for f, s := range map[string]*string{"foo": &p.foo, "bar": &p.bar, "value": &p.value} {
+			if *s, err = d.String(f); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	},
+	Encode: func(p MessagePayload) (Document, error) {
+		v, ok := p.(LatestPayload)
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %T for version %d", p, vLatest)
+		}
+		return Document{"foo": v.foo, "bar": v.bar, "value": v.value}, nil
+	},
+}
+
+var resetV1Schema = Schema{
+	Decode: func(Document) (MessagePayload, error) {
+		return ResetV1Payload{}, nil
+	},
+	Encode: func(p MessagePayload) (Document, error) {
+		if _, ok := p.(ResetV1Payload); !ok {
+			return nil, fmt.Errorf("unsupported type %T for version %d", p, resetV1)
+		}
+		return Document{}, nil
+	},
+}
+
+var resetVLatestSchema = Schema{
+	Required: []string{"value"},
+	Decode: func(d Document) (MessagePayload, error) {
+		v, err := d.String("value")
+		return LatestResetPayload{value: v}, err
+	},
+	Encode: func(p MessagePayload) (Document, error) {
+		v, ok := p.(LatestResetPayload)
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %T for version %d", p, resetVLatest)
+		}
+		return Document{"value": v.value}, nil
+	},
+}
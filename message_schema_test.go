@@ -0,0 +1,156 @@
+package messaging_spike
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConsumePersistedJSONMessages(t *testing.T) {
+	latestVersionConsumer := &LatestMessageVersionOnlyConsumer{}
+	r := DefaultMigrations()
+	c, err := NewMessageUpgradeDecorator(latestVersionConsumer, r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, spec := range []struct {
+		json            string
+		foo, bar, value string
+	}{
+		{`{"type":"StateUpdated","version":1,"payload":{"value":"first"}}`, "defaultFoo", "defaultBar", "first"},
+		{`{"type":"StateReset","version":1}`, "", "", "init"},
+		{`{"type":"StateUpdated","version":2,"payload":{"foo":"myFoo","value":"second"}}`, "myFoo", "defaultBar", "second"},
+		{`{"type":"StateReset","version":2,"payload":{"value":"reset"}}`, "", "", "reset"},
+		{`{"type":"StateUpdated","version":3,"payload":{"foo":"anotherFoo","bar":"anotherBar","value":"latest"}}`, "anotherFoo", "anotherBar", "latest"},
+	} {
+		// when
+		m, err := r.Decode([]byte(spec.json))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := c.OnEvent(m); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// then
+		exp := LatestMessageVersionOnlyConsumer{state: spec.value, foo: spec.foo, bar: spec.bar}
+		if got := *latestVersionConsumer; got != exp {
+			t.Errorf("expected %+v but got %+v", exp, got)
+		}
+	}
+}
+
+func TestDecodeRejectsInvalidDocuments(t *testing.T) {
+	r := DefaultMigrations()
+	for name, json := range map[string]string{
+		"syntax":          `{"type":"StateUpdated",`,
+		"unknown type":    `{"type":"Unknown","version":1,"payload":{"value":"first"}}`,
+		"unknown vers.":   `{"type":"StateUpdated","version":4,"payload":{"value":"first"}}`,
+		"missing field":   `{"type":"StateUpdated","version":3,"payload":{"foo":"myFoo","value":"latest"}}`,
+		"wrong type":      `{"type":"StateUpdated","version":1,"payload":{"value":1}}`,
+		"missing payload": `{"type":"StateUpdated","version":1}`,
+	} {
+		if _, err := r.Decode([]byte(json)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestValidateRejectsSchemasWithoutMigrations(t *testing.T) {
+	// given a schema of a version no migration upgrades
+	r := DefaultMigrations().RegisterSchema(stateUpdatedType, 7, v1Schema)
+	// when
+	err := r.Validate()
+	// then
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got, exp := err.Error(), `gap in migration chain of "StateUpdated": no migration from version 7 to 3`; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	r := DefaultMigrations()
+	for _, m := range []VersionableMessage{
+		{messageType: stateUpdatedType, version: v1, content: V1Payload("first")},
+		{messageType: stateUpdatedType, version: v2, content: V2Payload{content: map[string]string{"foo": "myFoo", "value": "second"}}},
+		{messageType: stateUpdatedType, version: vLatest, content: LatestPayload{foo: "myFoo", bar: "myBar", value: "latest"}},
+		{messageType: stateResetType, version: resetV1, content: ResetV1Payload{}},
+		{messageType: stateResetType, version: resetVLatest, content: LatestResetPayload{value: "reset"}},
+	} {
+		// when
+		b, err := r.Encode(m)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got, err := r.Decode(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// then
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("expected %+v but got %+v", m, got)
+		}
+	}
+}
+
+func TestMigrateRawDocuments(t *testing.T) {
+	// given a message type that is only known as JSON
+	const note = "Note"
+	r := NewMigrationRegistry().
+		MessageType(note, 3).
+		RegisterSchema(note, 1, Schema{Required: []string{"text"}}).
+		RegisterSchema(note, 2, Schema{Required: []string{"body", "author"}}).
+		RegisterSchema(note, 3, Schema{Required: []string{"body", "author", "tags"}}).
+		Register(note, 1, 2, MigrateDocument(RenameField("text", "body"), AddField("author", "unknown"))).
+		Register(note, 2, 3, MigrateDocument(DefaultValue("author", "anonymous"), DefaultValue("tags", []interface{}{})))
+	if err := r.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, spec := range []struct {
+		json string
+		exp  Document
+	}{
+		{`{"type":"Note","version":1,"payload":{"text":"hello"}}`, Document{"body": "hello", "author": "unknown", "tags": []interface{}{}}},
+		{`{"type":"Note","version":2,"payload":{"body":"hello","author":null}}`, Document{"body": "hello", "author": "anonymous", "tags": []interface{}{}}},
+		{`{"type":"Note","version":3,"payload":{"body":"hello","author":"alex","tags":["a"]}}`, Document{"body": "hello", "author": "alex", "tags": []interface{}{"a"}}},
+	} {
+		m, err := r.Decode([]byte(spec.json))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// when
+		v, got, err := r.Upgrade(m.Type(), m.Version(), m.Content())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// then
+		if v != 3 {
+			t.Errorf("expected version 3 but got %d", v)
+		}
+		if !reflect.DeepEqual(got, spec.exp) {
+			t.Errorf("expected %#v but got %#v", spec.exp, got)
+		}
+		// and the persisted document is not modified
+		if reflect.DeepEqual(m.Content(), got) && m.Version() != 3 {
+			t.Errorf("source document was modified: %#v", m.Content())
+		}
+	}
+}
+
+func TestDocumentTransformsFailOnConflicts(t *testing.T) {
+	for name, m := range map[string]TypedMigration{
+		"add":    MigrateDocument(AddField("body", "x")),
+		"rename": MigrateDocument(RenameField("text", "body")),
+		"typed":  MigrateDocument(),
+	} {
+		var p MessagePayload = Document{"text": "hello", "body": "hello"}
+		if name == "typed" {
+			p = V1Payload("hello")
+		}
+		if _, err := m.Migration(p); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -1,20 +1,44 @@
 package messaging_spike
 
-import "fmt"
+import (
+	"fmt"
+	"reflect"
+)
+
+// message types
+const (
+	stateUpdatedType = "StateUpdated"
+	stateResetType   = "StateReset"
+)
 
+// versions of StateUpdated
 const (
 	v1      uint = 1
 	v2      uint = 2
 	vLatest uint = 3
 )
 
+// versions of StateReset
+const (
+	resetV1      uint = 1
+	resetVLatest uint = 2
+)
+
 type MessagePayload interface{}
 
 type VersionableMessage struct {
-	version uint
-	content MessagePayload
+	id          string // identity of the persisted message, optional
+	messageType string
+	version     uint
+	content     MessagePayload
 }
 
+func (v VersionableMessage) ID() string {
+	return v.id
+}
+func (v VersionableMessage) Type() string {
+	return v.messageType
+}
 func (v VersionableMessage) Version() uint {
 	return v.version
 }
@@ -31,61 +55,153 @@ type LatestPayload struct {
 	foo, bar, value string
 }
 
-type Migration func(MessagePayload) (uint, MessagePayload, error)
+type ResetV1Payload struct{}
+
+type LatestResetPayload struct {
+	value string
+}
+
+// Migration converts a payload into the format of the next version.
+type Migration func(MessagePayload) (MessagePayload, error)
 
-type MessageUpgradeDecorator struct {
-	c          *LatestMessageVersionOnlyConsumer
-	migrations map[uint]Migration
+// Consumer is any consumer handling events of type T, like CoffeeOrderConsumer or FooModel.
+type Consumer[T any] interface {
+	OnEvent(T) error
 }
 
-func NewMessageUpgradeDecorator(c *LatestMessageVersionOnlyConsumer) *MessageUpgradeDecorator {
-	d := &MessageUpgradeDecorator{c: c}
-	d.migrations = map[uint]Migration{
-		v1: migrateMessageV1ToV2,
-		v2: migrateMessageV2ToVLatest,
+// MessageUpgradeDecorator is the anti corruption layer in front of a consumer that only
+// knows the latest versions. Upgraded payloads must be of the consumer's event type T.
+type MessageUpgradeDecorator[T any] struct {
+	c          Consumer[T]
+	migrations *MigrationRegistry
+	cache      *MigrationCache
+}
+
+// NewMessageUpgradeDecorator fails when the migration chain of the registry is incomplete.
+func NewMessageUpgradeDecorator[T any](c Consumer[T], r *MigrationRegistry) (*MessageUpgradeDecorator[T], error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
 	}
-	return d
+	return &MessageUpgradeDecorator[T]{c: c, migrations: r}, nil
 }
 
-func (f *MessageUpgradeDecorator) OnEvent(e VersionableMessage) error {
-	v := e.Version()
-	c := e.Content()
-	for upgrade, ok := f.migrations[v]; ok; upgrade, ok = f.migrations[v] {
-		var err error
-		if v, c, err = upgrade(c); err != nil {
-			return fmt.Errorf("%T failed to upgrade: %v", upgrade, err)
-		}
+// NewCachingMessageUpgradeDecorator does not run the migrations again for messages replayed
+// with the same ID and version but takes the upgraded payload from the cache.
+func NewCachingMessageUpgradeDecorator[T any](c Consumer[T], r *MigrationRegistry, cache *MigrationCache) (*MessageUpgradeDecorator[T], error) {
+	d, err := NewMessageUpgradeDecorator(c, r)
+	if err != nil {
+		return nil, err
+	}
+	d.cache = cache
+	return d, nil
+}
+
+func (f *MessageUpgradeDecorator[T]) OnEvent(e VersionableMessage) error {
+	c, err := f.upgrade(e)
+	if err != nil {
+		return err
 	}
-	l, ok := c.(LatestPayload)
+	l, ok := c.(T)
 	if !ok {
-		return fmt.Errorf("migration failed. unsupported content type: %T, Version: %d", c, v)
+		return fmt.Errorf("migration failed. unsupported content type: %T, Version: %d, expected %v", c, e.Version(), reflect.TypeOf((*T)(nil)).Elem())
 	}
 	return f.c.OnEvent(l)
 }
 
+func (f *MessageUpgradeDecorator[T]) upgrade(e VersionableMessage) (MessagePayload, error) {
+	if f.cache == nil || e.ID() == "" {
+		_, c, err := f.migrations.Upgrade(e.Type(), e.Version(), e.Content())
+		return c, err
+	}
+	if c, ok := f.cache.get(e); ok {
+		return c, nil
+	}
+	_, c, err := f.migrations.Upgrade(e.Type(), e.Version(), e.Content())
+	if err != nil {
+		return nil, err
+	}
+	f.cache.add(e, c)
+	return c, nil
+}
+
+// MessageDowngradeDecorator sits on the producer side. During rolling deploys it emits
+// messages in the versions negotiated with a consumer that does not know the latest ones yet.
+type MessageDowngradeDecorator struct {
+	c          Consumer[VersionableMessage]
+	migrations *MigrationRegistry
+	versions   map[string]uint
+}
+
+// NewMessageDowngradeDecorator negotiates the versions with the newest version accepted by the
+// consumer per message type. Message types not listed are emitted unchanged.
+func NewMessageDowngradeDecorator(c Consumer[VersionableMessage], r *MigrationRegistry, accepted map[string]uint) (*MessageDowngradeDecorator, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	d := &MessageDowngradeDecorator{c: c, migrations: r, versions: make(map[string]uint, len(accepted))}
+	for t, v := range accepted {
+		n, err := r.Negotiate(t, v)
+		if err != nil {
+			return nil, err
+		}
+		d.versions[t] = n
+	}
+	return d, nil
+}
+
+func (d *MessageDowngradeDecorator) OnEvent(e VersionableMessage) error {
+	target, ok := d.versions[e.Type()]
+	if !ok || e.Version() <= target {
+		return d.c.OnEvent(e)
+	}
+	c, err := d.migrations.Downgrade(e.Type(), e.Version(), target, e.Content())
+	if err != nil {
+		return err
+	}
+	return d.c.OnEvent(VersionableMessage{id: e.ID(), messageType: e.Type(), version: target, content: c})
+}
+
+// LatestMessageVersionOnlyConsumer handles the latest version of every message type.
 type LatestMessageVersionOnlyConsumer struct {
 	state, foo, bar string
 }
 
-func (l *LatestMessageVersionOnlyConsumer) OnEvent(p LatestPayload) error {
-	l.state = p.value
-	l.foo = p.foo
-	l.bar = p.bar
+func (l *LatestMessageVersionOnlyConsumer) OnEvent(p MessagePayload) error {
+	switch ev := p.(type) {
+	case LatestPayload:
+		l.state = ev.value
+		l.foo = ev.foo
+		l.bar = ev.bar
+	case LatestResetPayload:
+		l.state = ev.value
+		l.foo = ""
+		l.bar = ""
+	default:
+		return fmt.Errorf("migration failed. unsupported content type: %T", p)
+	}
 	return nil
 }
 
-func migrateMessageV1ToV2(s MessagePayload) (uint, MessagePayload, error) {
-	p, ok := s.(V1Payload)
-	if !ok {
-		return 0, nil, fmt.Errorf("unsupported type %T for version %d", p, v1)
-	}
-	return v2, V2Payload{content: map[string]string{"foo": "defaultFoo", "value": string(p)}}, nil
+func upgradeV1ToV2(p V1Payload) (V2Payload, error) {
+	return V2Payload{content: map[string]string{"foo": "defaultFoo", "value": string(p)}}, nil
 }
 
-func migrateMessageV2ToVLatest(s MessagePayload) (uint, MessagePayload, error) {
-	p, ok := s.(V2Payload)
-	if !ok {
-		return 0, nil, fmt.Errorf("unsupported type %T for version %d", p, v2)
-	}
-	return vLatest, LatestPayload{foo: p.content["foo"], bar: "defaultBar", value: p.content["value"]}, nil
+func upgradeV2ToVLatest(p V2Payload) (LatestPayload, error) {
+	return LatestPayload{foo: p.content["foo"], bar: "defaultBar", value: p.content["value"]}, nil
+}
+
+func upgradeResetV1ToVLatest(ResetV1Payload) (LatestResetPayload, error) {
+	return LatestResetPayload{value: "init"}, nil
+}
+
+func downgradeVLatestToV2(p LatestPayload) (V2Payload, error) {
+	return V2Payload{content: map[string]string{"foo": p.foo, "value": p.value}}, nil
+}
+
+func downgradeV2ToV1(p V2Payload) (V1Payload, error) {
+	return V1Payload(p.content["value"]), nil
+}
+
+func downgradeResetVLatestToV1(LatestResetPayload) (ResetV1Payload, error) {
+	return ResetV1Payload{}, nil
 }
@@ -1,20 +1,32 @@
 package messaging_spike
 
-import "testing"
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestUpgradeMessages(t *testing.T) {
-	v1 := VersionableMessage{version: 1, content: V1Payload("first")}
-	v2 := VersionableMessage{version: 2, content: V2Payload{content: map[string]string{"foo": "myFoo", "value": "second"}}}
-	latestVersion := VersionableMessage{version: 3, content: LatestPayload{foo: "anotherFoo", bar: "anotherBar", value: "latest"}}
+	v1 := VersionableMessage{messageType: stateUpdatedType, version: 1, content: V1Payload("first")}
+	v2 := VersionableMessage{messageType: stateUpdatedType, version: 2, content: V2Payload{content: map[string]string{"foo": "myFoo", "value": "second"}}}
+	latestVersion := VersionableMessage{messageType: stateUpdatedType, version: 3, content: LatestPayload{foo: "anotherFoo", bar: "anotherBar", value: "latest"}}
+	resetV1 := VersionableMessage{messageType: stateResetType, version: 1, content: ResetV1Payload{}}
+	resetLatest := VersionableMessage{messageType: stateResetType, version: 2, content: LatestResetPayload{value: "reset"}}
 	latestVersionConsumer := &LatestMessageVersionOnlyConsumer{}
-	c := NewMessageUpgradeDecorator(latestVersionConsumer)
+	c, err := NewMessageUpgradeDecorator(latestVersionConsumer, DefaultMigrations())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
 
 	for _, spec := range []struct {
 		m               VersionableMessage
 		foo, bar, value string
 	}{
 		{v1, "defaultFoo", "defaultBar", "first"},
+		{resetV1, "", "", "init"},
 		{v2, "myFoo", "defaultBar", "second"},
+		{resetLatest, "", "", "reset"},
 		{latestVersion, "anotherFoo", "anotherBar", "latest"},
 	} {
 		// when
@@ -33,3 +45,228 @@ func TestUpgradeMessages(t *testing.T) {
 		}
 	}
 }
+
+func TestMigrationRegistryValidation(t *testing.T) {
+	noop := Migration(func(p MessagePayload) (MessagePayload, error) { return p, nil })
+	const other = "Other"
+	for name, spec := range map[string]struct {
+		r     *MigrationRegistry
+		valid bool
+	}{
+		"default":    {DefaultMigrations(), true},
+		"empty":      {NewMigrationRegistry(), true},
+		"latestOnly": {NewMigrationRegistry().MessageType(other, v1), true},
+		"gap":        {NewMigrationRegistry().MessageType(other, vLatest).Register(other, v1, v2, noop), false},
+		"skip":       {NewMigrationRegistry().MessageType(other, vLatest).Register(other, v1, vLatest, noop).Register(other, v2, vLatest, noop), true},
+		"cycle":      {NewMigrationRegistry().MessageType(other, vLatest).Register(other, v1, v2, noop).Register(other, v2, v1, noop), false},
+		"duplicate":  {NewMigrationRegistry().MessageType(other, vLatest).Register(other, v1, vLatest, noop).Register(other, v1, v2, noop), false},
+		"fromLatest": {NewMigrationRegistry().MessageType(other, v2).Register(other, v1, v2, noop).Register(other, v2, vLatest, noop), false},
+		"undeclared": {NewMigrationRegistry().Register(other, v1, v2, noop), false},
+		"redeclared": {NewMigrationRegistry().MessageType(other, v1).MessageType(other, v2), false},
+	} {
+		// when
+		err := spec.r.Validate()
+		// then
+		if got, exp := err == nil, spec.valid; got != exp {
+			t.Errorf("%s: expected valid %v but got error: %v", name, exp, err)
+		}
+	}
+}
+
+func TestMigrationChainsAreSeparatedByMessageType(t *testing.T) {
+	// given a StateReset message in a version that only exists for StateUpdated
+	r := DefaultMigrations()
+	// when
+	_, _, err := r.Upgrade(stateResetType, vLatest, LatestPayload{})
+	// then
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestUpgradeDecoratorRejectsIncompleteMigrations(t *testing.T) {
+	r := NewMigrationRegistry().MessageType(stateUpdatedType, vLatest).Register(stateUpdatedType, v1, v2, Migrate(upgradeV1ToV2))
+	if _, err := NewMessageUpgradeDecorator(&LatestMessageVersionOnlyConsumer{}, r); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestUpgradeFailsOnUnknownVersionOrType(t *testing.T) {
+	c, err := NewMessageUpgradeDecorator(&LatestMessageVersionOnlyConsumer{}, DefaultMigrations())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, m := range []VersionableMessage{
+		{messageType: stateUpdatedType, version: 0, content: V1Payload("unknown")},
+		{messageType: "Unknown", version: v1, content: V1Payload("unknown")},
+	} {
+		if err := c.OnEvent(m); err == nil {
+			t.Errorf("expected error for %+v", m)
+		}
+	}
+}
+
+func TestDowngradeMessagesForOlderConsumers(t *testing.T) {
+	latest := VersionableMessage{id: "1", messageType: stateUpdatedType, version: vLatest, content: LatestPayload{foo: "myFoo", bar: "myBar", value: "latest"}}
+	reset := VersionableMessage{id: "2", messageType: stateResetType, version: resetVLatest, content: LatestResetPayload{value: "reset"}}
+	old := VersionableMessage{messageType: stateUpdatedType, version: v1, content: V1Payload("old")}
+
+	for _, spec := range []struct {
+		accepted map[string]uint
+		exp      []VersionableMessage
+	}{
+		{
+			accepted: map[string]uint{stateUpdatedType: v2, stateResetType: resetV1},
+			exp: []VersionableMessage{
+				{id: "1", messageType: stateUpdatedType, version: v2, content: V2Payload{content: map[string]string{"foo": "myFoo", "value": "latest"}}},
+				{id: "2", messageType: stateResetType, version: resetV1, content: ResetV1Payload{}},
+				old,
+			},
+		},
+		{
+			accepted: map[string]uint{stateUpdatedType: v1},
+			exp: []VersionableMessage{
+				{id: "1", messageType: stateUpdatedType, version: v1, content: V1Payload("latest")},
+				reset,
+				old,
+			},
+		},
+		{
+			accepted: map[string]uint{stateUpdatedType: vLatest + 1},
+			exp:      []VersionableMessage{latest, reset, old},
+		},
+	} {
+		c := &recordingVersionableMessageConsumer{}
+		d, err := NewMessageDowngradeDecorator(c, DefaultMigrations(), spec.accepted)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// when
+		for _, m := range []VersionableMessage{latest, reset, old} {
+			if err := d.OnEvent(m); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		// then
+		if got, exp := c.received, spec.exp; !reflect.DeepEqual(got, exp) {
+			t.Errorf("expected %+v but got %+v", exp, got)
+		}
+	}
+}
+
+func TestDowngradedMessagesCanBeUpgradedAgain(t *testing.T) {
+	// given a producer emitting for a consumer that only understands version 2
+	latestVersionConsumer := &LatestMessageVersionOnlyConsumer{}
+	u, err := NewMessageUpgradeDecorator(latestVersionConsumer, DefaultMigrations())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	d, err := NewMessageDowngradeDecorator(u, DefaultMigrations(), map[string]uint{stateUpdatedType: v2})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// when
+	m := VersionableMessage{messageType: stateUpdatedType, version: vLatest, content: LatestPayload{foo: "myFoo", bar: "myBar", value: "latest"}}
+	if err := d.OnEvent(m); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// then fields unknown to version 2 get their defaults
+	exp := LatestMessageVersionOnlyConsumer{state: "latest", foo: "myFoo", bar: "defaultBar"}
+	if got := *latestVersionConsumer; got != exp {
+		t.Errorf("expected %+v but got %+v", exp, got)
+	}
+}
+
+func TestNegotiationFailsWithoutDowngrade(t *testing.T) {
+	for name, accepted := range map[string]map[string]uint{
+		"too old": {stateUpdatedType: 0},
+		"unknown": {"Unknown": v1},
+	} {
+		if _, err := NewMessageDowngradeDecorator(&recordingVersionableMessageConsumer{}, DefaultMigrations(), accepted); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+type recordingVersionableMessageConsumer struct {
+	received []VersionableMessage
+}
+
+func (r *recordingVersionableMessageConsumer) OnEvent(m VersionableMessage) error {
+	r.received = append(r.received, m)
+	return nil
+}
+
+// consumers the anti corruption layer can be put in front of
+var (
+	_ Consumer[Event]        = (*CoffeeOrderConsumer)(nil)
+	_ Consumer[ModelEvent]   = (*FooModel)(nil)
+	_ Consumer[ClockedEvent] = (*SourceProcessConsumer)(nil)
+)
+
+func TestUpgradeDecoratorInFrontOfCoffeeOrderConsumer(t *testing.T) {
+	// given coffee orders that were published as "customer:kind" strings in version 1
+	r := NewMigrationRegistry().
+		MessageType("CoffeeOrdered", 2).
+		Register("CoffeeOrdered", 1, 2, Migrate(func(s string) (Coffee, error) {
+			customer, kind, ok := strings.Cut(s, ":")
+			if !ok {
+				return Coffee{}, fmt.Errorf("invalid coffee order %q", s)
+			}
+			return Coffee{customer: customer, kind: kind}, nil
+		})).
+		MessageType("SugarOrdered", 1).
+		MessageType("PlaceChosen", 1)
+	o := NewCoffeeOrderConsumer()
+	c, err := NewMessageUpgradeDecorator(o, r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	for _, m := range []VersionableMessage{
+		{messageType: "CoffeeOrdered", version: 1, content: "Alex:flat white"},
+		{messageType: "SugarOrdered", version: 1, content: Sugar{"Alex", true}},
+		{messageType: "PlaceChosen", version: 1, content: Place{"Alex", inHouse}},
+	} {
+		if err := c.OnEvent(m); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	exp := OrderCreated{customer: "Alex", kind: "flat white", sugar: true, where: inHouse}
+	if got := o.StateEvents[len(o.StateEvents)-1]; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestUpgradeDecoratorInFrontOfFooModel(t *testing.T) {
+	// given
+	r := NewMigrationRegistry().
+		MessageType("ModelUpdated", 2).
+		Register("ModelUpdated", 1, 2, Migrate(func(p V1Payload) (ModelEvent, error) {
+			return ModelEvent{seqID: 1, newState: string(p)}, nil
+		})).
+		MessageType(stateUpdatedType, vLatest)
+	m := &FooModel{state: "init"}
+	c, err := NewMessageUpgradeDecorator(m, r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// when
+	if err := c.OnEvent(VersionableMessage{messageType: "ModelUpdated", version: 1, content: V1Payload("first")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// and a message type that does not upgrade to a ModelEvent
+	err = c.OnEvent(VersionableMessage{messageType: stateUpdatedType, version: vLatest, content: LatestPayload{value: "other"}})
+
+	// then
+	if err == nil {
+		t.Error("expected error")
+	}
+	if got, exp := *m, (FooModel{version: 1, state: "first"}); got != exp {
+		t.Errorf("expected %+v but got %+v", exp, got)
+	}
+}
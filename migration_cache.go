@@ -0,0 +1,88 @@
+package messaging_spike
+
+import (
+	"container/list"
+	"sync"
+)
+
+type migrationCacheKey struct {
+	id          string
+	messageType string
+	version     uint
+}
+
+type migrationCacheEntry struct {
+	key     migrationCacheKey
+	payload MessagePayload
+}
+
+// MigrationCacheStats are the metrics of a MigrationCache.
+type MigrationCacheStats struct {
+	Hits, Misses, Evictions uint64
+	Size                    int
+}
+
+// MigrationCache keeps the upgraded payloads of persisted messages that are replayed many
+// times during sourcing. It is bounded to a maximum number of entries and evicts the least
+// recently used one. Cached payloads are shared and must not be modified by consumers.
+type MigrationCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[migrationCacheKey]*list.Element
+	lru      *list.List
+	stats    MigrationCacheStats
+}
+
+func NewMigrationCache(capacity int) *MigrationCache {
+	return &MigrationCache{
+		capacity: capacity,
+		entries:  make(map[migrationCacheKey]*list.Element, capacity),
+		lru:      list.New(),
+	}
+}
+
+func (c *MigrationCache) Stats() MigrationCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Size = c.lru.Len()
+	return s
+}
+
+func (c *MigrationCache) get(m VersionableMessage) (MessagePayload, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKeyOf(m)]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*migrationCacheEntry).payload, true
+}
+
+func (c *MigrationCache) add(m VersionableMessage, p MessagePayload) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	k := cacheKeyOf(m)
+	if e, ok := c.entries[k]; ok {
+		e.Value.(*migrationCacheEntry).payload = p
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.lru.PushFront(&migrationCacheEntry{key: k, payload: p})
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*migrationCacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+func cacheKeyOf(m VersionableMessage) migrationCacheKey {
+	return migrationCacheKey{id: m.ID(), messageType: m.Type(), version: m.Version()}
+}
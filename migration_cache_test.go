@@ -0,0 +1,77 @@
+package messaging_spike
+
+import "testing"
+
+func TestReplayedMessagesAreUpgradedOnce(t *testing.T) {
+	// given
+	upgrades := 0
+	r := NewMigrationRegistry().
+		MessageType(stateUpdatedType, vLatest).
+		Register(stateUpdatedType, v1, vLatest, Migrate(func(p V1Payload) (LatestPayload, error) {
+			upgrades++
+			return upgradeV2ToVLatest(V2Payload{content: map[string]string{"value": string(p)}})
+		}))
+	cache := NewMigrationCache(10)
+	consumer := &LatestMessageVersionOnlyConsumer{}
+	c, err := NewCachingMessageUpgradeDecorator(consumer, r, cache)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	m := VersionableMessage{id: "1", messageType: stateUpdatedType, version: v1, content: V1Payload("first")}
+
+	// when replayed
+	for i := 0; i < 3; i++ {
+		if err := c.OnEvent(m); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// and messages without identity are not cached
+	anonymous := VersionableMessage{messageType: stateUpdatedType, version: v1, content: V1Payload("anonymous")}
+	for i := 0; i < 2; i++ {
+		if err := c.OnEvent(anonymous); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	if got, exp := upgrades, 3; got != exp {
+		t.Errorf("expected %d upgrades but got %d", exp, got)
+	}
+	if got, exp := cache.Stats(), (MigrationCacheStats{Hits: 2, Misses: 1, Size: 1}); got != exp {
+		t.Errorf("expected %+v but got %+v", exp, got)
+	}
+	if got, exp := consumer.state, "anonymous"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+}
+
+func TestMigrationCacheIsBounded(t *testing.T) {
+	// given
+	cache := NewMigrationCache(2)
+	c, err := NewCachingMessageUpgradeDecorator(&LatestMessageVersionOnlyConsumer{}, DefaultMigrations(), cache)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msg := func(id string, v uint, p MessagePayload) VersionableMessage {
+		return VersionableMessage{id: id, messageType: stateUpdatedType, version: v, content: p}
+	}
+
+	// when
+	for _, m := range []VersionableMessage{
+		msg("1", v1, V1Payload("first")),
+		msg("2", v1, V1Payload("second")),
+		msg("1", v1, V1Payload("first")),                                      // hit, 2 is now least recently used
+		msg("3", v1, V1Payload("third")),                                      // evicts 2
+		msg("2", v1, V1Payload("second")),                                     // miss, evicts 1
+		msg("3", v2, V2Payload{content: map[string]string{"value": "third"}}), // other version is another entry
+	} {
+		if err := c.OnEvent(m); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// then
+	if got, exp := cache.Stats(), (MigrationCacheStats{Hits: 1, Misses: 5, Evictions: 3, Size: 2}); got != exp {
+		t.Errorf("expected %+v but got %+v", exp, got)
+	}
+}
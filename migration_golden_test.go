@@ -0,0 +1,80 @@
+package messaging_spike
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGoldens = flag.Bool("update", false, "record the golden files of the migration chain")
+
+// Every historic version of a message type needs fixtures in testdata/migrations/<type>/v<version>.jsonl.
+// The upgraded messages are compared with v<version>.golden.jsonl. Run the tests with -update
+// to record the golden files after adding a new migration or fixture.
+func TestMigrationChainGoldenFiles(t *testing.T) {
+	r := DefaultMigrations()
+	for _, messageType := range r.messageTypes() {
+		for _, v := range append(r.versions(messageType), r.latest[messageType]) {
+			t.Run(fmt.Sprintf("%s/v%d", messageType, v), func(t *testing.T) {
+				assertMigrationGolden(t, r, messageType, v)
+			})
+		}
+	}
+}
+
+func assertMigrationGolden(t *testing.T, r *MigrationRegistry, messageType string, v uint) {
+	t.Helper()
+	dir := filepath.Join("testdata", "migrations", messageType)
+	fixtures, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("v%d.jsonl", v)))
+	if err != nil {
+		t.Fatalf("missing fixtures for %q version %d: %s", messageType, v, err)
+	}
+	got := upgradeFixtures(t, r, messageType, v, fixtures)
+
+	goldenFile := filepath.Join(dir, fmt.Sprintf("v%d.golden.jsonl", v))
+	if *updateGoldens {
+		if err := os.WriteFile(goldenFile, got, 0o644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return
+	}
+	exp, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("missing golden file, record it with -update: %s", err)
+	}
+	if !bytes.Equal(got, exp) {
+		t.Errorf("upgraded messages do not match %s:\nexpected\n%s\nbut got\n%s", goldenFile, exp, got)
+	}
+}
+
+func upgradeFixtures(t *testing.T, r *MigrationRegistry, messageType string, v uint, fixtures []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(fixtures))
+	for line := 1; s.Scan(); line++ {
+		m, err := r.Decode(s.Bytes())
+		if err != nil {
+			t.Fatalf("line %d: unexpected error: %s", line, err)
+		}
+		if m.Type() != messageType || m.Version() != v {
+			t.Fatalf("line %d: expected %q version %d but got %q version %d", line, messageType, v, m.Type(), m.Version())
+		}
+		latest, c, err := r.Upgrade(m.Type(), m.Version(), m.Content())
+		if err != nil {
+			t.Fatalf("line %d: unexpected error: %s", line, err)
+		}
+		b, err := r.Encode(VersionableMessage{messageType: messageType, version: latest, content: c})
+		if err != nil {
+			t.Fatalf("line %d: unexpected error: %s", line, err)
+		}
+		out.Write(append(b, '\n'))
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,237 @@
+package messaging_spike
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+type migrationKey struct {
+	messageType string
+	version     uint
+}
+
+type registeredMigration struct {
+	to      uint
+	migrate Migration
+	in, out reflect.Type // payload types of typed steps, nil otherwise
+}
+
+// MigrationRegistry collects the migrations of all message types. Migrations are registered
+// declaratively and validated once at startup, so that a gap or a cycle in a chain fails
+// early instead of on the first old message received.
+type MigrationRegistry struct {
+	latest     map[string]uint
+	migrations map[migrationKey]registeredMigration
+	downgrades map[migrationKey]registeredMigration
+	schemas    map[migrationKey]Schema
+	errs       []error
+}
+
+func NewMigrationRegistry() *MigrationRegistry {
+	return &MigrationRegistry{
+		latest:     make(map[string]uint),
+		migrations: make(map[migrationKey]registeredMigration),
+		downgrades: make(map[migrationKey]registeredMigration),
+		schemas:    make(map[migrationKey]Schema),
+	}
+}
+
+// DefaultMigrations returns the migrations for all message versions ever published.
+func DefaultMigrations() *MigrationRegistry {
+	return NewMigrationRegistry().
+		MessageType(stateUpdatedType, vLatest).
+		RegisterSchema(stateUpdatedType, v1, v1Schema).
+		RegisterSchema(stateUpdatedType, v2, v2Schema).
+		RegisterSchema(stateUpdatedType, vLatest, vLatestSchema).
+		Register(stateUpdatedType, v1, v2, Migrate(upgradeV1ToV2)).
+		Register(stateUpdatedType, v2, vLatest, Migrate(upgradeV2ToVLatest)).
+		RegisterDowngrade(stateUpdatedType, vLatest, v2, Migrate(downgradeVLatestToV2)).
+		RegisterDowngrade(stateUpdatedType, v2, v1, Migrate(downgradeV2ToV1)).
+		MessageType(stateResetType, resetVLatest).
+		RegisterSchema(stateResetType, resetV1, resetV1Schema).
+		RegisterSchema(stateResetType, resetVLatest, resetVLatestSchema).
+		Register(stateResetType, resetV1, resetVLatest, Migrate(upgradeResetV1ToVLatest)).
+		RegisterDowngrade(stateResetType, resetVLatest, resetV1, Migrate(downgradeResetVLatestToV1))
+}
+
+// MessageType declares a message type with its latest version.
+func (r *MigrationRegistry) MessageType(name string, latest uint) *MigrationRegistry {
+	if _, exists := r.latest[name]; exists {
+		r.errs = append(r.errs, fmt.Errorf("duplicate message type %q", name))
+		return r
+	}
+	r.latest[name] = latest
+	return r
+}
+
+// Register adds a migration from one version of a message type to another. Invalid
+// registrations are collected and reported by Validate.
+func (r *MigrationRegistry) Register(messageType string, from, to uint, m MigrationStep) *MigrationRegistry {
+	k := migrationKey{messageType: messageType, version: from}
+	switch _, exists := r.migrations[k]; {
+	case exists:
+		r.errs = append(r.errs, fmt.Errorf("duplicate migration for %q from version %d", messageType, from))
+	case from == r.latest[messageType]:
+		r.errs = append(r.errs, fmt.Errorf("migration for %q from latest version %d", messageType, from))
+	default:
+		r.migrations[k] = registered(to, m)
+	}
+	return r
+}
+
+// RegisterDowngrade adds a migration from one version of a message type to an older one,
+// used to emit messages for consumers that do not know the latest version yet.
+func (r *MigrationRegistry) RegisterDowngrade(messageType string, from, to uint, m MigrationStep) *MigrationRegistry {
+	k := migrationKey{messageType: messageType, version: from}
+	switch _, exists := r.downgrades[k]; {
+	case exists:
+		r.errs = append(r.errs, fmt.Errorf("duplicate downgrade for %q from version %d", messageType, from))
+	case to >= from:
+		r.errs = append(r.errs, fmt.Errorf("downgrade for %q from version %d to newer version %d", messageType, from, to))
+	default:
+		r.downgrades[k] = registered(to, m)
+	}
+	return r
+}
+
+func registered(to uint, s MigrationStep) registeredMigration {
+	m, in, out := s.step()
+	return registeredMigration{to: to, migrate: m, in: in, out: out}
+}
+
+// Validate ensures that the chain from every known version of a message type reaches
+// its latest version without gaps or cycles, and that the payload types of neighbouring
+// typed steps match.
+func (r *MigrationRegistry) Validate() error {
+	if len(r.errs) != 0 {
+		return r.errs[0]
+	}
+	for _, migrations := range []map[migrationKey]registeredMigration{r.migrations, r.downgrades} {
+		for k := range migrations {
+			if _, ok := r.latest[k.messageType]; !ok {
+				return fmt.Errorf("migration for undeclared message type %q", k.messageType)
+			}
+		}
+	}
+	for name, migrations := range map[string]map[migrationKey]registeredMigration{"migration": r.migrations, "downgrade": r.downgrades} {
+		for k, m := range migrations {
+			next, ok := migrations[migrationKey{k.messageType, m.to}]
+			if ok && !fits(m.out, next.in) {
+				return fmt.Errorf("%s chain of %q: version %d to %d yields %v but version %d to %d expects %v",
+					name, k.messageType, k.version, m.to, m.out, m.to, next.to, next.in)
+			}
+		}
+	}
+	for k := range r.schemas {
+		if _, ok := r.latest[k.messageType]; !ok {
+			return fmt.Errorf("schema for undeclared message type %q", k.messageType)
+		}
+	}
+	for _, t := range r.messageTypes() {
+		latest := r.latest[t]
+		for _, from := range r.versions(t) {
+			seen := make(map[uint]struct{})
+			for v := from; v != latest; v = r.migrations[migrationKey{t, v}].to {
+				if _, ok := seen[v]; ok {
+					return fmt.Errorf("cycle in migration chain of %q at version %d", t, v)
+				}
+				seen[v] = struct{}{}
+				if _, ok := r.migrations[migrationKey{t, v}]; !ok {
+					return fmt.Errorf("gap in migration chain of %q: no migration from version %d to %d", t, v, latest)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Upgrade walks the migration chain of the message type from the given version up to
+// its latest version.
+func (r *MigrationRegistry) Upgrade(messageType string, v uint, c MessagePayload) (uint, MessagePayload, error) {
+	latest, ok := r.latest[messageType]
+	if !ok {
+		return v, nil, fmt.Errorf("unknown message type %q", messageType)
+	}
+	for m, ok := r.migrations[migrationKey{messageType, v}]; ok; m, ok = r.migrations[migrationKey{messageType, v}] {
+		var err error
+		if c, err = m.migrate(c); err != nil {
+			return v, nil, fmt.Errorf("failed to upgrade %q from version %d to %d: %v", messageType, v, m.to, err)
+		}
+		v = m.to
+	}
+	if v != latest {
+		return v, nil, fmt.Errorf("no migration for %q from version %d to %d", messageType, v, latest)
+	}
+	return v, c, nil
+}
+
+// Negotiate returns the newest version of a message type that a consumer accepting versions
+// up to the given one can read and that the downgrade chain from the latest version reaches.
+func (r *MigrationRegistry) Negotiate(messageType string, accepted uint) (uint, error) {
+	latest, ok := r.latest[messageType]
+	if !ok {
+		return 0, fmt.Errorf("unknown message type %q", messageType)
+	}
+	v := latest
+	for m, ok := r.downgrades[migrationKey{messageType, v}]; ok && v > accepted; m, ok = r.downgrades[migrationKey{messageType, v}] {
+		v = m.to
+	}
+	if v > accepted {
+		return 0, fmt.Errorf("no downgrade for %q from version %d to %d or older", messageType, v, accepted)
+	}
+	return v, nil
+}
+
+// Downgrade walks the downgrade chain of the message type from the given version down to
+// the target version.
+func (r *MigrationRegistry) Downgrade(messageType string, v, target uint, c MessagePayload) (MessagePayload, error) {
+	for m, ok := r.downgrades[migrationKey{messageType, v}]; ok && v > target; m, ok = r.downgrades[migrationKey{messageType, v}] {
+		var err error
+		if c, err = m.migrate(c); err != nil {
+			return nil, fmt.Errorf("failed to downgrade %q from version %d to %d: %v", messageType, v, m.to, err)
+		}
+		v = m.to
+	}
+	if v != target {
+		return nil, fmt.Errorf("no downgrade for %q from version %d to %d", messageType, v, target)
+	}
+	return c, nil
+}
+
+// messageTypes returns all declared message types in alphabetical order.
+func (r *MigrationRegistry) messageTypes() []string {
+	t := make([]string, 0, len(r.latest))
+	for k := range r.latest {
+		t = append(t, k)
+	}
+	sort.Strings(t)
+	return t
+}
+
+// versions returns all known versions of a message type but the latest in ascending order:
+// those of migrations and schemas.
+func (r *MigrationRegistry) versions(messageType string) []uint {
+	latest := r.latest[messageType]
+	all := make(map[uint]struct{})
+	for k, m := range r.migrations {
+		if k.messageType != messageType {
+			continue
+		}
+		all[k.version] = struct{}{}
+		if m.to != latest {
+			all[m.to] = struct{}{}
+		}
+	}
+	for k := range r.schemas {
+		if k.messageType == messageType && k.version != latest {
+			all[k.version] = struct{}{}
+		}
+	}
+	v := make([]uint, 0, len(all))
+	for k := range all {
+		v = append(v, k)
+	}
+	sort.Slice(v, func(i, j int) bool { return v[i] < v[j] })
+	return v
+}
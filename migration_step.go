@@ -0,0 +1,70 @@
+package messaging_spike
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Step is a migration between two payload types, checked by the compiler.
+type Step[From, To any] func(From) (To, error)
+
+// Then composes two steps. The output of the first step must match the input of the next
+// one at compile time.
+func Then[A, B, C any](first Step[A, B], next Step[B, C]) Step[A, C] {
+	return func(a A) (C, error) {
+		b, err := first(a)
+		if err != nil {
+			var c C
+			return c, err
+		}
+		return next(b)
+	}
+}
+
+// TypedMigration is a Migration built from a typed step. It keeps the payload types, so that
+// a MigrationRegistry can check that neighbouring steps of a chain fit together.
+type TypedMigration struct {
+	Migration
+	from, to reflect.Type
+}
+
+// MigrationStep is a migration accepted by a MigrationRegistry: a plain Migration or a
+// TypedMigration.
+type MigrationStep interface {
+	step() (m Migration, from, to reflect.Type)
+}
+
+// payload types are unknown for a plain Migration
+func (m Migration) step() (Migration, reflect.Type, reflect.Type) {
+	return m, nil, nil
+}
+
+func (m TypedMigration) step() (Migration, reflect.Type, reflect.Type) {
+	return m.Migration, m.from, m.to
+}
+
+// Migrate adapts a typed step to a Migration, so that it can be registered in the
+// heterogeneous chain of a MigrationRegistry. Payloads of another type are rejected.
+func Migrate[From, To any](s Step[From, To]) TypedMigration {
+	from, to := reflect.TypeOf((*From)(nil)).Elem(), reflect.TypeOf((*To)(nil)).Elem()
+	return TypedMigration{
+		Migration: func(p MessagePayload) (MessagePayload, error) {
+			f, ok := p.(From)
+			if !ok {
+				return nil, fmt.Errorf("unsupported type %T, expected %v", p, from)
+			}
+			return s(f)
+		},
+		from: from,
+		to:   to,
+	}
+}
+
+// fits is false when the output of a step can never be the input of the next one. Unknown
+// types and interfaces fit, as the concrete type is only known at runtime.
+func fits(out, in reflect.Type) bool {
+	if out == nil || in == nil || out.Kind() == reflect.Interface {
+		return true
+	}
+	return out.AssignableTo(in)
+}
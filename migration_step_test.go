@@ -0,0 +1,82 @@
+package messaging_spike
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestComposedStepsMatchRegistryChain(t *testing.T) {
+	// given the full chain of StateUpdated as one type checked step
+	upgradeV1ToLatest := Then(Step[V1Payload, V2Payload](upgradeV1ToV2), upgradeV2ToVLatest)
+
+	// when
+	typed, err := upgradeV1ToLatest(V1Payload("first"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, walked, err := DefaultMigrations().Upgrade(stateUpdatedType, v1, V1Payload("first"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// then
+	exp := LatestPayload{foo: "defaultFoo", bar: "defaultBar", value: "first"}
+	if typed != exp {
+		t.Errorf("expected %+v but got %+v", exp, typed)
+	}
+	if walked != exp {
+		t.Errorf("expected %+v but got %+v", exp, walked)
+	}
+}
+
+func TestThenStopsOnFirstError(t *testing.T) {
+	failure := errors.New("failure")
+	called := false
+	s := Then(
+		func(V1Payload) (V2Payload, error) { return V2Payload{}, failure },
+		func(V2Payload) (LatestPayload, error) { called = true; return LatestPayload{}, nil },
+	)
+	if _, err := s(V1Payload("first")); err != failure {
+		t.Errorf("expected %v but got %v", failure, err)
+	}
+	if called {
+		t.Error("next step should not be called")
+	}
+}
+
+func TestMigrateRejectsUnexpectedPayloadType(t *testing.T) {
+	m := Migrate(upgradeV1ToV2)
+	if _, err := m.Migration(V2Payload{}); err == nil {
+		t.Fatal("expected error")
+	}
+	got, err := m.Migration(V1Payload("first"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := got.(V2Payload); !ok {
+		t.Errorf("expected V2Payload but got %T", got)
+	}
+}
+
+func TestValidateRejectsMismatchingTypedSteps(t *testing.T) {
+	// given a chain whose second step expects the payload of version 1
+	fromV1 := func(V1Payload) (LatestPayload, error) { return LatestPayload{}, nil }
+	r := NewMigrationRegistry().
+		MessageType(stateUpdatedType, vLatest).
+		Register(stateUpdatedType, v1, v2, Migrate(upgradeV1ToV2)).
+		Register(stateUpdatedType, v2, vLatest, Migrate(fromV1))
+	// when
+	err := r.Validate()
+	// then
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// and the matching step is valid
+	r = NewMigrationRegistry().
+		MessageType(stateUpdatedType, vLatest).
+		Register(stateUpdatedType, v1, v2, Migrate(upgradeV1ToV2)).
+		Register(stateUpdatedType, v2, vLatest, Migrate(upgradeV2ToVLatest))
+	if err := r.Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
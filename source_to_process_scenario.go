@@ -1,7 +1,11 @@
 package messaging_spike
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"sort"
 )
 
 const (
@@ -9,20 +13,55 @@ const (
 	ModeProcessing
 )
 
+var modeNames = []string{"sourcing", "processing"}
+
+// DuplicatePolicy defines how a consumer handles a message received before. With at-least-once
+// delivery duplicates are normal. When sourcing, events replayed from the state before sourcing
+// started are no duplicates; events delivered again while sourcing are.
+type DuplicatePolicy int
+
+const (
+	DuplicatesFail          DuplicatePolicy = iota // return ErrDuplicateMessage
+	DuplicatesSkip                                 // ignore silently
+	DuplicatesSkipAndReport                        // ignore, count and log them
+)
+
+// discardLogger is the silent default of all injectable loggers.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// loggerOrDiscard returns the injected logger, or the silent default when it is nil.
+func loggerOrDiscard(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return discardLogger
+	}
+	return l
+}
+
 type ClockedEvent interface {
 	VectorClock() VectorClock
 }
 
 // Any events created by some Event Producer
 type ExternalEventMessage struct {
+	id          string
 	vectorClock VectorClock
-	newState    string // for simplicity, state value is unique
+	newState    string
 }
 
 func (e ExternalEventMessage) VectorClock() VectorClock {
 	return e.vectorClock
 }
 
+// ID identifies the message for duplicate detection. Without an explicit ID the producer's
+// tick identifies the message.
+func (e ExternalEventMessage) ID() string {
+	if e.id != "" {
+		return e.id
+	}
+	tick, _ := e.vectorClock.Get(e.vectorClock.name)
+	return fmt.Sprintf("%d/%d", e.vectorClock.name, tick)
+}
+
 // state events created by SourceProcessConsumer
 type InternalConsumerUpdatedMessage struct {
 	vectorClock VectorClock
@@ -38,13 +77,22 @@ type ClockedEventCallback func(ClockedEvent)
 type SourceProcessConsumer struct {
 	vectorClock              VectorClock
 	sourcedClock             VectorClock
+	sourcingFrom             VectorClock // events not after it were part of the state when sourcing started
 	state                    string
 	name                     int
 	Mode                     int
 	StateEvents              []ClockedEvent // for simplicity: writing to StateEvents is persisting the event
 	beforeProcessingCallback ClockedEventCallback
-	eventLog                 *failOnDuplicatesEventLog
+	eventLog                 *IdempotencyLog
+	duplicatePolicy          DuplicatePolicy
+	duplicates               uint64         // reported duplicates
+	highWaterMarks           HighWaterMarks // sourcing completes when reached; clock heuristics when nil
+	pending                  []ClockedEvent // beyond the high water marks, processed after sourcing
 	autoStartProcessing      bool
+	Logger                   *slog.Logger // silent by default
+	snapshots                SnapshotStore
+	snapshotEvery            int // state updates between snapshots
+	updates                  int // since the last snapshot
 }
 
 func NewAutoStartConsumer(name int) *SourceProcessConsumer {
@@ -55,19 +103,63 @@ func NewAutoStartConsumer(name int) *SourceProcessConsumer {
 
 func NewManualStartConsumer(name int) *SourceProcessConsumer {
 	return &SourceProcessConsumer{
-		name:         name,
-		vectorClock:  NewVectorClock(name),
-		sourcedClock: NewVectorClock(name),
-		StateEvents:  make([]ClockedEvent, 0),
-		Mode:         ModeSourcing,
+		name:                     name,
+		vectorClock:              NewVectorClock(name),
+		sourcedClock:             NewVectorClock(name),
+		sourcingFrom:             NewVectorClock(name),
+		StateEvents:              make([]ClockedEvent, 0),
+		Mode:                     ModeSourcing,
 		beforeProcessingCallback: func(ClockedEvent) {},
-		eventLog:                 newFailOnDuplicatesEventLog(),
+		eventLog:                 NewIdempotencyLog(defaultIdempotencyLimit, 0),
+		Logger:                   discardLogger,
 	}
 }
 
+// WithIdempotencyLog replaces the default duplicate detection of the last 10000 messages.
+func (c *SourceProcessConsumer) WithIdempotencyLog(l *IdempotencyLog) *SourceProcessConsumer {
+	c.eventLog = l
+	return c
+}
+
+func (c *SourceProcessConsumer) WithDuplicatePolicy(p DuplicatePolicy) *SourceProcessConsumer {
+	c.duplicatePolicy = p
+	return c
+}
+
+// Duplicates returns the number of duplicates skipped with DuplicatesSkipAndReport.
+func (c *SourceProcessConsumer) Duplicates() uint64 {
+	return c.duplicates
+}
+
+// HighWaterMarks are the latest ticks of every input by name when the consumer starts: of
+// the producers and of the consumer's own state events.
+type HighWaterMarks map[int]uint64
+
+// HighWaterMarksOf returns the marks of the latest events of the inputs.
+func HighWaterMarksOf(latest ...ClockedEvent) HighWaterMarks {
+	marks := make(HighWaterMarks, len(latest))
+	for _, e := range latest {
+		c := e.VectorClock()
+		if tick, _ := c.Get(c.name); tick > marks[c.name] {
+			marks[c.name] = tick
+		}
+	}
+	return marks
+}
+
+// WithHighWaterMarks completes sourcing when the events of all inputs are sourced up to the
+// marks instead of relying on clock heuristics. Events beyond the marks received while
+// sourcing are processed when sourcing completed.
+func (c *SourceProcessConsumer) WithHighWaterMarks(marks HighWaterMarks) *SourceProcessConsumer {
+	c.highWaterMarks = marks
+	return c
+}
+
 func (c *SourceProcessConsumer) OnEvent(e ClockedEvent) error {
 	if c.autoStartProcessing && c.Mode == ModeSourcing && c.IsSourcingCompleted(e) {
-		c.enableProcessingMode()
+		if err := c.enableProcessingMode(); err != nil {
+			return err
+		}
 	}
 	if c.Mode == ModeProcessing {
 		return c.processEvent(e)
@@ -79,47 +171,155 @@ func (c *SourceProcessConsumer) IsSourcingCompleted(e ClockedEvent) bool {
 	if c.Mode == ModeProcessing {
 		return true
 	}
+	if c.highWaterMarks != nil {
+		return c.highWaterMarksReached()
+	}
 	if _, ok := e.(*InternalConsumerUpdatedMessage); ok { // we source our internal state messages first by convention
 		return false
 	}
 	return c.clocksSynced()
 }
 
-func (c *SourceProcessConsumer) enableProcessingMode() {
-	fmt.Printf("switching to processing mode: %+v\n", c)
+func (c *SourceProcessConsumer) highWaterMarksReached() bool {
+	for name, mark := range c.highWaterMarks {
+		if tick, _ := c.sourcedClock.Get(name); tick < mark {
+			return false
+		}
+	}
+	return true
+}
+
+// beyondHighWaterMark is true for events of an input after its mark.
+func (c *SourceProcessConsumer) beyondHighWaterMark(e ClockedEvent) bool {
+	if c.highWaterMarks == nil {
+		return false
+	}
+	return producerTick(e) > c.highWaterMarks[e.VectorClock().name]
+}
+
+// producerTick is the tick of the event's producer.
+func producerTick(e ClockedEvent) uint64 {
+	clock := e.VectorClock()
+	tick, _ := clock.Get(clock.name)
+	return tick
+}
+
+func (c *SourceProcessConsumer) isPending(id string) bool {
+	for _, p := range c.pending {
+		if p.(*ExternalEventMessage).ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// enableProcessingMode switches to processing and processes the events held back while sourcing
+// in the order of their producers' ticks.
+func (c *SourceProcessConsumer) enableProcessingMode() error {
 	c.Mode = ModeProcessing
+	c.log(slog.LevelInfo, "switched to processing mode", nil)
+	pending := c.pending
+	c.pending = nil
+	sort.SliceStable(pending, func(i, j int) bool {
+		return producerTick(pending[i]) < producerTick(pending[j])
+	})
+	errs := make([]error, 0, len(pending))
+	for _, e := range pending {
+		errs = append(errs, c.processEvent(e))
+	}
+	return errors.Join(errs...)
 }
 
+// DoSourcing switches to sourcing. High water marks are for one sourcing run: switching back
+// from processing drops them, so that new ones can be set for the next run.
 func (c *SourceProcessConsumer) DoSourcing() {
+	if c.Mode == ModeProcessing {
+		c.highWaterMarks = nil
+	}
 	c.sourcedClock = c.vectorClock
+	c.sourcingFrom = c.vectorClock
 	c.Mode = ModeSourcing
-	fmt.Printf("switching to sourcing mode: %+v\n", c)
+	c.log(slog.LevelInfo, "switched to sourcing mode", nil)
+}
+
+// log writes the message with the state of the consumer and the event, when given. The
+// attributes are only built when the level is enabled.
+func (c *SourceProcessConsumer) log(level slog.Level, msg string, e ClockedEvent, attrs ...slog.Attr) {
+	l, ctx := loggerOrDiscard(c.Logger), context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+	all := []slog.Attr{slog.Int("consumer", c.name), slog.String("mode", modeNames[c.Mode]), slog.Any("clock", c.vectorClock)}
+	if e != nil {
+		all = append(all, slog.String("event_type", fmt.Sprintf("%T", e)), slog.Any("event_clock", e.VectorClock()))
+	}
+	l.LogAttrs(ctx, level, msg, append(all, attrs...)...)
 }
 
 func (c *SourceProcessConsumer) clocksSynced() bool {
 	return c.sourcedClock.Equals(c.vectorClock)
 }
 func (c *SourceProcessConsumer) DoProcessing() error {
-	if !c.clocksSynced() {
+	if c.highWaterMarks != nil && !c.highWaterMarksReached() {
+		return fmt.Errorf("high water marks not reached")
+	}
+	if c.highWaterMarks == nil && !c.clocksSynced() {
 		return fmt.Errorf("internal clocks out of sync")
 	}
-	c.enableProcessingMode()
-	return nil
+	return c.enableProcessingMode()
+}
+
+// skipDuplicate applies the duplicate policy. It returns true when the message is to be skipped.
+func (c *SourceProcessConsumer) skipDuplicate(e ClockedEvent) (bool, error) {
+	ev, ok := e.(*ExternalEventMessage)
+	if !ok {
+		return false, nil
+	}
+	seen, err := c.eventLog.Seen(ev.ID())
+	if err != nil || !seen {
+		return false, err
+	}
+	switch c.duplicatePolicy {
+	case DuplicatesSkip:
+		return true, nil
+	case DuplicatesSkipAndReport:
+		c.duplicates++
+		c.log(slog.LevelWarn, "skipping duplicate", e, slog.String("id", ev.ID()))
+		return true, nil
+	default:
+		return false, fmt.Errorf("%w: %q", ErrDuplicateMessage, ev.ID())
+	}
 }
 
 func (c *SourceProcessConsumer) sourceEvent(e ClockedEvent) error {
-	fmt.Printf("sourcing event: %#v\n", e)
+	c.log(slog.LevelDebug, "sourcing event", e)
+	// replayed events were part of the state before sourcing started
+	if !e.VectorClock().After(c.sourcingFrom) {
+		c.log(slog.LevelDebug, "skipping event. already ahead", e, slog.Any("sourced_clock", c.sourcedClock))
+		return nil
+	}
+	// events delivered again while sourcing are duplicates
+	if skip, err := c.skipDuplicate(e); err != nil || skip {
+		return err
+	}
 	if !e.VectorClock().After(c.sourcedClock) {
-		fmt.Printf("skipping message. already ahead: clock at  %+v; event: %#v\n", c.sourcedClock, e)
+		c.log(slog.LevelDebug, "skipping event. already ahead", e, slog.Any("sourced_clock", c.sourcedClock))
+		return nil
+	}
+	if ev, ok := e.(*ExternalEventMessage); ok && c.beyondHighWaterMark(e) {
+		if c.isPending(ev.ID()) { // redelivered while held back
+			c.log(slog.LevelDebug, "skipping event. already held back", e)
+			return nil
+		}
+		c.log(slog.LevelDebug, "holding back event beyond high water mark", e)
+		c.pending = append(c.pending, e)
 		return nil
 	}
 
 	c.sourcedClock = c.sourcedClock.Merge(e.VectorClock().WithoutExternalTicks())
 	switch ev := e.(type) {
 	case *ExternalEventMessage:
-		if err := c.eventLog.Add(ev); err != nil {
-			return err
-		}
+		c.eventLog.record(ev.ID())
 	case *InternalConsumerUpdatedMessage:
 		c.state = ev.newState
 		c.vectorClock = e.VectorClock()
@@ -129,14 +329,17 @@ func (c *SourceProcessConsumer) sourceEvent(e ClockedEvent) error {
 
 	// check sourcing completed
 	if c.autoStartProcessing && c.IsSourcingCompleted(e) {
-		c.enableProcessingMode()
+		return c.enableProcessingMode()
 	}
 	return nil
 }
 
 func (c *SourceProcessConsumer) processEvent(e ClockedEvent) error {
 	c.beforeProcessingCallback(e)
-	fmt.Printf("processing event: %#v\n", e)
+	c.log(slog.LevelDebug, "processing event", e)
+	if skip, err := c.skipDuplicate(e); err != nil || skip {
+		return err
+	}
 
 	if !e.VectorClock().After(c.vectorClock) {
 		return fmt.Errorf("recieved message out or order: %+v, my %+v: %+v\n", e.VectorClock(), c.vectorClock, e)
@@ -145,37 +348,29 @@ func (c *SourceProcessConsumer) processEvent(e ClockedEvent) error {
 	c.vectorClock = c.vectorClock.Inc().Merge(e.VectorClock())
 	switch ev := e.(type) {
 	case *ExternalEventMessage:
-		if err := c.eventLog.Add(ev); err != nil {
-			return err
-		}
+		c.eventLog.record(ev.ID())
 		c.state = ev.newState
-		c.storeUpdate()
+		return c.storeUpdate()
 	default:
 		return fmt.Errorf("can not handle %T", e)
 	}
-	return nil
 }
-func (c *SourceProcessConsumer) storeUpdate() {
+func (c *SourceProcessConsumer) storeUpdate() error {
 	c.vectorClock = c.vectorClock.Inc()
 	c.StateEvents = append(c.StateEvents, &InternalConsumerUpdatedMessage{
 		vectorClock: c.vectorClock,
 		newState:    c.state,
 	})
-}
-
-type failOnDuplicatesEventLog struct {
-	msg map[string]struct{}
-}
-
-func newFailOnDuplicatesEventLog() *failOnDuplicatesEventLog {
-	return &failOnDuplicatesEventLog{msg: make(map[string]struct{})}
-}
-
-func (f *failOnDuplicatesEventLog) Add(e *ExternalEventMessage) error {
-	if _, ok := f.msg[e.newState]; ok {
-		return fmt.Errorf("already exists: %q", e.newState)
+	if c.snapshots == nil {
+		return nil
 	}
-	f.msg[e.newState] = struct{}{}
-	return nil
-
+	if c.updates++; c.updates < c.snapshotEvery {
+		return nil
+	}
+	c.updates = 0
+	s, err := c.snapshot()
+	if err != nil {
+		return err
+	}
+	return c.snapshots.Save(c.name, s)
 }
@@ -0,0 +1,108 @@
+package messaging_spike
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// ConsumerSnapshot is the state of a SourceProcessConsumer after a state update. It is
+// encoded as JSON to be persisted by a SnapshotStore.
+type ConsumerSnapshot struct {
+	state       string
+	vectorClock VectorClock
+	eventLog    []byte // saved IdempotencyLog
+}
+
+// persisted form of a ConsumerSnapshot
+type consumerSnapshotJSON struct {
+	State    string          `json:"state"`
+	Name     int             `json:"name"`
+	Clocks   map[int]uint64  `json:"clocks"`
+	EventLog json.RawMessage `json:"eventLog,omitempty"`
+}
+
+func (s ConsumerSnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(consumerSnapshotJSON{
+		State:    s.state,
+		Name:     s.vectorClock.name,
+		Clocks:   s.vectorClock.clocks,
+		EventLog: s.eventLog,
+	})
+}
+
+func (s *ConsumerSnapshot) UnmarshalJSON(b []byte) error {
+	var j consumerSnapshotJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	clock := NewVectorClock(j.Name)
+	for k, v := range j.Clocks {
+		clock.clocks[k] = v
+	}
+	*s = ConsumerSnapshot{state: j.State, vectorClock: clock, eventLog: j.EventLog}
+	return nil
+}
+
+// SnapshotStore keeps the latest snapshot of every consumer by name.
+type SnapshotStore interface {
+	Save(name int, s ConsumerSnapshot) error
+	Latest(name int) (ConsumerSnapshot, bool, error)
+}
+
+type MemorySnapshotStore struct {
+	mu        sync.Mutex
+	snapshots map[int]ConsumerSnapshot
+}
+
+func NewMemorySnapshotStore() *MemorySnapshotStore {
+	return &MemorySnapshotStore{snapshots: make(map[int]ConsumerSnapshot)}
+}
+
+func (m *MemorySnapshotStore) Save(name int, s ConsumerSnapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshots[name] = s
+	return nil
+}
+
+func (m *MemorySnapshotStore) Latest(name int) (ConsumerSnapshot, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.snapshots[name]
+	return s, ok, nil
+}
+
+// WithSnapshots saves a snapshot to the store after every n-th state update.
+func (c *SourceProcessConsumer) WithSnapshots(s SnapshotStore, n int) *SourceProcessConsumer {
+	c.snapshots = s
+	c.snapshotEvery = n
+	return c
+}
+
+// RestoreSnapshot starts sourcing from the latest snapshot in the store. Events with clocks
+// not after the snapshot are skipped then. It returns false when there is no snapshot.
+func (c *SourceProcessConsumer) RestoreSnapshot() (bool, error) {
+	if c.snapshots == nil {
+		return false, nil
+	}
+	s, ok, err := c.snapshots.Latest(c.name)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := c.eventLog.Load(bytes.NewReader(s.eventLog)); err != nil {
+		return false, err
+	}
+	c.state = s.state
+	c.vectorClock = s.vectorClock
+	c.DoSourcing()
+	return true, nil
+}
+
+func (c *SourceProcessConsumer) snapshot() (ConsumerSnapshot, error) {
+	var buf bytes.Buffer
+	if err := c.eventLog.Save(&buf); err != nil {
+		return ConsumerSnapshot{}, err
+	}
+	return ConsumerSnapshot{state: c.state, vectorClock: c.vectorClock, eventLog: buf.Bytes()}, nil
+}
@@ -0,0 +1,119 @@
+package messaging_spike
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSourceFromSnapshot(t *testing.T) {
+	// given a consumer that saves a snapshot every second update
+	snapshots := &countingSnapshotStore{SnapshotStore: NewMemorySnapshotStore()}
+	p := NewAutoStartConsumer(A).WithSnapshots(snapshots, 2)
+	q := NewSharedClocksMessageQueue(B, C).Add(B, "b1").Add(C, "c1").Add(B, "b2").Add(C, "c2").Add(B, "b3")
+	events := q.EventStream(ByTimeLine)
+	for _, e := range events {
+		if err := p.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if got, exp := snapshots.saved, 2; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	// when a new consumer starts from the latest snapshot
+	s := NewAutoStartConsumer(A).WithSnapshots(snapshots, 2)
+	if ok, err := s.RestoreSnapshot(); err != nil || !ok {
+		t.Fatalf("expected snapshot but got %v, %v", ok, err)
+	}
+	if got, exp := s.state, "c2"; got != exp {
+		t.Fatalf("expected %q but got %q", exp, got)
+	}
+	var sourced []string
+	s.beforeProcessingCallback = func(e ClockedEvent) {
+		t.Fatal("there should be nothing to process")
+	}
+	for _, e := range append(p.StateEvents, events...) {
+		if e.VectorClock().After(s.sourcedClock) {
+			sourced = append(sourced, stateOf(e))
+		}
+		if err := s.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// then only events after the snapshot were replayed
+	if got, exp := sourced, []string{"b3", "b3"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+	if got, exp := s.state, p.state; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := s.vectorClock, p.vectorClock; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+	if got, exp := s.Mode, ModeProcessing; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestRestoreWithoutSnapshot(t *testing.T) {
+	c := NewAutoStartConsumer(A).WithSnapshots(NewMemorySnapshotStore(), 1)
+	if ok, err := c.RestoreSnapshot(); err != nil || ok {
+		t.Errorf("expected no snapshot but got %v, %v", ok, err)
+	}
+}
+
+func TestSnapshotSurvivesJSON(t *testing.T) {
+	// given
+	p := NewAutoStartConsumer(A)
+	for _, e := range NewSharedClocksMessageQueue(B).Add(B, "b1").Add(B, "b2").EventStream(ByTimeLine) {
+		if err := p.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	s, err := p.snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var got ConsumerSnapshot
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	if got.state != s.state || !reflect.DeepEqual(got.vectorClock, s.vectorClock) {
+		t.Errorf("expected %v but got %v", s, got)
+	}
+	r := NewAutoStartConsumer(A)
+	if err := r.eventLog.Load(bytes.NewReader(got.eventLog)); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := r.eventLog.Len(), p.eventLog.Len(); got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+// countingSnapshotStore counts the snapshots saved.
+type countingSnapshotStore struct {
+	SnapshotStore
+	saved int
+}
+
+func (c *countingSnapshotStore) Save(name int, s ConsumerSnapshot) error {
+	c.saved++
+	return c.SnapshotStore.Save(name, s)
+}
+
+func stateOf(e ClockedEvent) string {
+	switch ev := e.(type) {
+	case *ExternalEventMessage:
+		return ev.newState
+	case *InternalConsumerUpdatedMessage:
+		return ev.newState
+	}
+	return ""
+}
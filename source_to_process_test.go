@@ -1,6 +1,11 @@
 package messaging_spike
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -101,6 +106,276 @@ func TestSwitchBackProcessToSourcing(t *testing.T) {
 
 }
 
+func TestConsumerLogsStructuredFields(t *testing.T) {
+	// given a consumer with a captured log
+	var buf bytes.Buffer
+	c := NewManualStartConsumer(A)
+	c.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	q := NewSharedClocksMessageQueue(B).Add(B, "b1")
+	// when
+	if err := c.DoProcessing(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := c.OnEvent(q.EventStream(ByTimeLine)[0]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	var records []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var r map[string]interface{}
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		records = append(records, r)
+	}
+	if got, exp := len(records), 2; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	if got, exp := records[0]["msg"], "switched to processing mode"; got != exp {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+	for k, exp := range map[string]interface{}{"msg": "processing event", "consumer": float64(A), "mode": "processing",
+		"clock": "0:[0:0]", "event_type": "*messaging_spike.ExternalEventMessage"} {
+		if got := records[1][k]; got != exp {
+			t.Errorf("%s: expected %v but got %v", k, exp, got)
+		}
+	}
+	if got, exp := records[1]["event_clock"], q.EventStream(ByTimeLine)[0].VectorClock().String(); got != exp {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+}
+
+func TestConsumerLogsNothingByDefault(t *testing.T) {
+	if got, exp := NewAutoStartConsumer(A).Logger.Enabled(context.Background(), slog.LevelError), false; got != exp {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+	if got, exp := NewVCModel(A).Logger.Enabled(context.Background(), slog.LevelError), false; got != exp {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+}
+
+func TestConsumerWithoutLoggerIsSilent(t *testing.T) {
+	// given
+	c, m := NewAutoStartConsumer(A), NewVCModel(B)
+	c.Logger, m.Logger = nil, nil
+	// when
+	for _, e := range NewSharedClocksMessageQueue(B).Add(B, "b1").EventStream(ByTimeLine) {
+		if err := c.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// then
+	if err := NewVCModel(A).SendTo(m, "a1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+}
+
+func TestDuplicatePoliciesWhenProcessing(t *testing.T) {
+	for _, policy := range []DuplicatePolicy{DuplicatesFail, DuplicatesSkip, DuplicatesSkipAndReport} {
+		// given
+		events := NewSharedClocksMessageQueue(B).Add(B, "b1").Add(B, "b2").EventStream(ByTimeLine)
+		c := NewAutoStartConsumer(A).WithDuplicatePolicy(policy)
+		if err := c.DoProcessing(); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		// when
+		var errs []error
+		for _, e := range []ClockedEvent{events[0], events[1], events[1]} {
+			errs = append(errs, c.OnEvent(e))
+		}
+		// then
+		assertDuplicatePolicy(t, policy, c, errs, []bool{false, false, true})
+		if got, exp := len(c.StateEvents), 2; got != exp {
+			t.Errorf("policy %d: expected %d but got %d", policy, exp, got)
+		}
+	}
+}
+
+func TestDuplicatePoliciesWhenSourcing(t *testing.T) {
+	for _, policy := range []DuplicatePolicy{DuplicatesFail, DuplicatesSkip, DuplicatesSkipAndReport} {
+		// given the state events of a previous run
+		events := NewSharedClocksMessageQueue(B).Add(B, "b1").Add(B, "b2").EventStream(ByTimeLine)
+		p := NewAutoStartConsumer(A)
+		for _, e := range events {
+			if err := p.OnEvent(e); err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+		}
+		c := NewManualStartConsumer(A).WithDuplicatePolicy(policy)
+		// when
+		var errs []error
+		for _, e := range append(p.StateEvents, events[0], events[0], events[1], events[1]) {
+			errs = append(errs, c.OnEvent(e))
+		}
+		// then
+		assertDuplicatePolicy(t, policy, c, errs, []bool{false, false, false, true, false, true})
+		if err := c.DoProcessing(); err != nil {
+			t.Errorf("policy %d: unexpected error %s", policy, err)
+		}
+	}
+}
+
+func TestSourcingSkipsEventsOfThePreviousState(t *testing.T) {
+	// given a consumer that processed an event
+	c := NewManualStartConsumer(A)
+	if err := c.DoProcessing(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	e := NewSharedClocksMessageQueue(B).Add(B, "b1").EventStream(ByTimeLine)[0]
+	if err := c.OnEvent(e); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when it is replayed after switching to sourcing
+	c.DoSourcing()
+	// then it is no duplicate
+	if err := c.OnEvent(e); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+// assertDuplicatePolicy checks the errors of redelivered events, duplicate by index, and the
+// state of the consumer with the policy.
+func assertDuplicatePolicy(t *testing.T, policy DuplicatePolicy, c *SourceProcessConsumer, errs []error, duplicate []bool) {
+	t.Helper()
+	var reported uint64
+	for i, err := range errs {
+		if duplicate[i] && policy == DuplicatesFail {
+			if !errors.Is(err, ErrDuplicateMessage) {
+				t.Errorf("policy %d: %d: expected %v but got %v", policy, i, ErrDuplicateMessage, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("policy %d: %d: unexpected error %s", policy, i, err)
+		}
+		if duplicate[i] && policy == DuplicatesSkipAndReport {
+			reported++
+		}
+	}
+	if got, exp := c.Duplicates(), reported; got != exp {
+		t.Errorf("policy %d: expected %d but got %d", policy, exp, got)
+	}
+	if got, exp := c.state, "b2"; got != exp {
+		t.Errorf("policy %d: expected %q but got %q", policy, exp, got)
+	}
+}
+
+func TestSourcingCompletesAtHighWaterMarks(t *testing.T) {
+	// given a consumer with state events of a previous run
+	q := NewSharedClocksMessageQueue(B, C).Add(B, "b1").Add(C, "c1").Add(B, "b2")
+	p := NewAutoStartConsumer(A)
+	for _, e := range q.EventStream(ByTimeLine) {
+		if err := p.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	events := q.EventStream(ByTimeLine)
+	marks := HighWaterMarksOf(append(p.StateEvents, events...)...)
+	latest := q.New().Add(B, "b3").EventStream(ByTimeLine)[0] // produced after startup
+
+	// when inputs are received in different order and speed
+	s := NewAutoStartConsumer(A).WithHighWaterMarks(marks)
+	var processed []ClockedEvent
+	s.beforeProcessingCallback = func(e ClockedEvent) {
+		processed = append(processed, e)
+	}
+	for _, e := range append([]ClockedEvent{events[0], latest, events[1]}, append(p.StateEvents, events[2])...) {
+		if err := s.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+
+	// then only the event after the marks was processed once all inputs were sourced
+	if got, exp := processed, []ClockedEvent{latest}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+	if got, exp := s.state, "b3"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := len(s.StateEvents), 1; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestDoProcessingRequiresHighWaterMarks(t *testing.T) {
+	c := NewManualStartConsumer(A).WithHighWaterMarks(HighWaterMarks{B: 1})
+	if err := c.DoProcessing(); err == nil {
+		t.Error("expected error")
+	}
+	if err := c.OnEvent(&ExternalEventMessage{vectorClock: NewVectorClock(B).Inc(), newState: "b1"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := c.DoProcessing(); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+func TestEventsHeldBackAtHighWaterMarksAreDeduplicated(t *testing.T) {
+	// given
+	q := NewSharedClocksMessageQueue(B).Add(B, "b1").Add(B, "b2")
+	events := q.EventStream(ByTimeLine)
+	s := NewAutoStartConsumer(A).WithHighWaterMarks(HighWaterMarksOf(events[0]))
+	var processed []ClockedEvent
+	s.beforeProcessingCallback = func(e ClockedEvent) {
+		processed = append(processed, e)
+	}
+	// when the event after the mark is redelivered before sourcing completed
+	for _, e := range []ClockedEvent{events[1], events[1], events[0]} {
+		if err := s.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// then it is processed once
+	if got, exp := processed, []ClockedEvent{events[1]}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+}
+
+func TestEventsHeldBackAtHighWaterMarksAreProcessedInOrder(t *testing.T) {
+	// given
+	q := NewSharedClocksMessageQueue(B).Add(B, "b1").Add(B, "b2").Add(B, "b3")
+	events := q.EventStream(ByTimeLine)
+	s := NewAutoStartConsumer(A).WithHighWaterMarks(HighWaterMarksOf(events[0]))
+	var processed []ClockedEvent
+	s.beforeProcessingCallback = func(e ClockedEvent) {
+		processed = append(processed, e)
+	}
+	// when the events after the mark arrive out of order
+	for _, e := range []ClockedEvent{events[2], events[1], events[0]} {
+		if err := s.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// then they are processed in order
+	if got, exp := processed, []ClockedEvent{events[1], events[2]}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v but got %v", exp, got)
+	}
+	if got, exp := s.state, "b3"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+}
+
+func TestDoSourcingDropsReachedHighWaterMarks(t *testing.T) {
+	// given a consumer that completed sourcing at its marks
+	c := NewManualStartConsumer(A).WithHighWaterMarks(HighWaterMarks{B: 1})
+	if err := c.OnEvent(&ExternalEventMessage{vectorClock: NewVectorClock(B).Inc(), newState: "b1"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := c.DoProcessing(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	c.DoSourcing()
+	// then the next run needs new marks
+	if c.highWaterMarks != nil {
+		t.Errorf("expected no marks but got %v", c.highWaterMarks)
+	}
+	c.WithHighWaterMarks(HighWaterMarks{B: 2})
+	if err := c.DoProcessing(); err == nil {
+		t.Error("expected error")
+	}
+}
+
 const (
 	ByTimeLine = iota
 	ByProducer
@@ -154,7 +429,7 @@ func (q MessageQueue) New() *MessageQueue {
 
 func (q *MessageQueue) Add(producer int, newState string) *MessageQueue {
 	var newClock VectorClock
-	for i, x := 0, rand.Int()%1000; i < x; i++ { // random clock step
+	for i, x := 0, rand.Int()%1000+1; i < x; i++ { // random clock step of at least one tick
 		newClock = q.incrementClock(producer)
 		q.vc[producer] = newClock
 	}
@@ -0,0 +1,560 @@
+package messaging_spike
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var ErrConflictingCorrection = errors.New("conflicting correction. revision is not higher than received before")
+
+// AggregatePart declares an event type that is part of an aggregate and how to extract the
+// correlation key from it.
+type AggregatePart struct {
+	name string
+	key  func(Event) (string, bool)
+}
+
+// PartOf declares events of type T as the named part, correlated by the key function.
+func PartOf[T Event](name string, key func(T) string) AggregatePart {
+	return AggregatePart{name: name, key: func(e Event) (string, bool) {
+		t, ok := e.(T)
+		if !ok {
+			return "", false
+		}
+		return key(t), true
+	}}
+}
+
+func (p AggregatePart) match(e Event) (string, bool) {
+	if p.key == nil {
+		return "", false
+	}
+	e, _ = revisionOf(e)
+	return p.key(e)
+}
+
+// Revised marks an event as a revision of a part. Parts without it are revision 0.
+type Revised struct {
+	event    Event
+	revision uint
+}
+
+func Revise(e Event, revision uint) Revised {
+	return Revised{event: e, revision: revision}
+}
+
+func revisionOf(e Event) (Event, uint) {
+	if r, ok := e.(Revised); ok {
+		return r.event, r.revision
+	}
+	return e, 0
+}
+
+// CorrectionPolicy defines how a part is handled that was received before with another value.
+// Parts with a lower revision than received before are outdated and always ignored.
+type CorrectionPolicy int
+
+const (
+	LastWriteWins   = iota // the part received last replaces the previous one
+	RejectConflicts        // a changed part requires a higher revision, otherwise ErrConflictingCorrection
+)
+
+// CompletionPolicy decides whether an aggregate in flight is complete with the parts present
+// by name. The trigger is always present. Any predicate on the parts can be a policy.
+type CompletionPolicy func(parts map[string]Event) bool
+
+// AllOf completes when all the named parts are present.
+func AllOf(names ...string) CompletionPolicy {
+	return AnyOf(len(names), names...)
+}
+
+// AnyOf completes when at least n of the named parts are present.
+func AnyOf(n int, names ...string) CompletionPolicy {
+	return func(parts map[string]Event) bool {
+		present := 0
+		for _, name := range names {
+			if _, ok := parts[name]; ok {
+				present++
+			}
+		}
+		return present >= n
+	}
+}
+
+// AggregateBuilder builds the state event of an aggregate from its parts by name. Default
+// values are added before; missing names the parts still absent, as the completion policy
+// can be met without all parts. It fails when the parts present do not make an aggregate.
+type AggregateBuilder func(parts map[string]Event, missing []string) (Event, error)
+
+// AggregatorConfig describes an aggregate: when the trigger part arrives, the other parts are
+// collected until the completion policy is met. The other parts may arrive before or after the
+// trigger. With a timeout, aggregates in flight are completed with default values for the
+// missing parts when possible, or expired otherwise.
+type AggregatorConfig struct {
+	Trigger     AggregatePart
+	Parts       []AggregatePart                   // collected besides the trigger
+	Completion  CompletionPolicy                  // all parts required when nil
+	Complete    AggregateBuilder                  // builds the completed aggregate event; aggregates can not complete when nil
+	Completed   AggregatePart                     // recognizes completed aggregate events when sourcing
+	Timeout     time.Duration                     // since the trigger arrived; no expiry when 0
+	Defaults    map[string]func(key string) Event // values of optional parts missing on completion or timeout
+	Expire      func(map[string]Event) Event      // builds the state event of an expired aggregate from the parts present; none when nil
+	Expired     AggregatePart                     // recognizes expired aggregate events when sourcing
+	Corrections CorrectionPolicy
+	Amend       AggregateBuilder // builds the state event of a completed aggregate with changed parts; completed aggregates are not kept when nil
+	Codec       EventCodec       // of the parts in snapshots; coffee order events when nil
+}
+
+func (c *AggregatorConfig) isComplete(parts map[string]Event) bool {
+	if c.Completion == nil {
+		return len(parts) == len(c.Parts)+1
+	}
+	return c.Completion(parts)
+}
+
+// withDefaults adds the default values of missing parts and returns if they complete the aggregate.
+func (c *AggregatorConfig) withDefaults(key string, parts map[string]Event) (map[string]Event, bool) {
+	if len(c.Defaults) == 0 {
+		return parts, false
+	}
+	filled := make(map[string]Event, len(parts)+len(c.Defaults))
+	for name, e := range parts {
+		filled[name] = e
+	}
+	for name, d := range c.Defaults {
+		if _, ok := filled[name]; !ok {
+			filled[name] = d(key)
+		}
+	}
+	return filled, c.isComplete(filled)
+}
+
+func (c *AggregatorConfig) partOf(e Event) (string, string, bool) {
+	for _, p := range append([]AggregatePart{c.Trigger}, c.Parts...) {
+		if key, ok := p.match(e); ok {
+			return p.name, key, true
+		}
+	}
+	return "", "", false
+}
+
+// PartialAggregate is the state event of an aggregate in flight. The one of the trigger holds
+// the parts collected so far, the following ones the changed part only (delta).
+type PartialAggregate struct {
+	key   string
+	since time.Time // when the trigger arrived
+	parts map[string]Event
+}
+
+// aggregateStarted is kept in the store for every aggregate in flight to expire it.
+type aggregateStarted struct {
+	key string
+	at  time.Time
+}
+
+const (
+	startedPrefix   = "started/"
+	completedPrefix = "completed/" // trigger of a completed aggregate that can be amended
+)
+
+func partKey(part, key string) string {
+	return part + "/" + key
+}
+
+// Aggregator correlates events by key and emits a completed aggregate event once all
+// parts of an aggregate are present (EIP aggregator).
+type Aggregator struct {
+	StateEvents []Event // for simplicity: writing to StateEvents is persisting the event
+	config      *AggregatorConfig
+	store       Store            // all parts received; a stored trigger is an aggregate in flight
+	now         func() time.Time // time.Now when nil
+	offset      int              // events of the log included in the state: consumed, emitted or sourced
+}
+
+func NewAggregator(c *AggregatorConfig, s Store) *Aggregator {
+	return &Aggregator{
+		config:      c,
+		store:       s,
+		StateEvents: make([]Event, 0),
+	}
+}
+
+// WithClock replaces time.Now for the timeouts of aggregates in flight.
+func (a *Aggregator) WithClock(now func() time.Time) *Aggregator {
+	a.now = now
+	return a
+}
+
+// Offset returns the number of events of the log included in the state: the events consumed
+// and emitted, or sourced, since creation or the restored snapshot.
+func (a *Aggregator) Offset() int {
+	return a.offset
+}
+
+// process event
+func (a *Aggregator) OnEvent(e Event) error {
+	emitted := len(a.StateEvents)
+	err := a.onEvent(e)
+	if err == nil {
+		a.offset++
+	}
+	a.offset += len(a.StateEvents) - emitted
+	return err
+}
+
+func (a *Aggregator) onEvent(e Event) error {
+	part, key, ok := a.config.partOf(e)
+	if !ok {
+		return fmt.Errorf("unsupported event: %T", e)
+	}
+	trigger := a.config.Trigger.name
+	_, inFlight, err := a.store.Get(partKey(trigger, key))
+	if err != nil {
+		return err
+	}
+	_, completed, err := a.store.Get(completedPrefix + key)
+	if err != nil {
+		return err
+	}
+	storeKey := partKey(part, key)
+	if part == trigger && !inFlight && completed {
+		storeKey = completedPrefix + key
+	}
+	changed, err := a.changes(storeKey, e, a.config.Corrections)
+	if err != nil || !changed {
+		return err
+	}
+	if !inFlight {
+		if completed {
+			return a.amend(key, part, e)
+		}
+		if part != trigger {
+			return a.store.Put(storeKey, e)
+		}
+	}
+	parts, err := a.parts(key)
+	if err != nil {
+		return err
+	}
+	parts[part] = e
+	if a.config.isComplete(parts) { // all dependencies are fulfilled, move on
+		// the part is stored only when the aggregate could be built, so that a redelivery retries
+		completed, err := a.build(a.config.Complete, key, parts)
+		if err != nil {
+			return err
+		}
+		if err := a.store.Put(storeKey, e); err != nil {
+			return err
+		}
+		a.StateEvents = append(a.StateEvents, completed)
+		return a.finish(key, true)
+	}
+	if err := a.store.Put(storeKey, e); err != nil {
+		return err
+	}
+	since := a.time()
+	if inFlight {
+		started, _, err := a.store.Get(startedPrefix + key)
+		if err != nil {
+			return err
+		}
+		since = started.(aggregateStarted).at
+		parts = map[string]Event{part: e}
+	} else if err := a.store.Put(startedPrefix+key, aggregateStarted{key: key, at: since}); err != nil {
+		return err
+	}
+	a.StateEvents = append(a.StateEvents, PartialAggregate{key: key, since: since, parts: parts})
+	return nil
+}
+
+// Compact folds the partial aggregate events of each aggregate into one and removes those
+// superseded by a completed or expired aggregate event. It is meant to run periodically on
+// the persisted state events; sourcing the result restores the same state.
+func (a *Aggregator) Compact(events []Event) []Event {
+	out := make([]Event, 0, len(events))
+	pending := make(map[string]int) // position of the folded partial of an aggregate in flight
+	for _, e := range events {
+		if p, ok := e.(PartialAggregate); ok {
+			if i, ok := pending[p.key]; ok {
+				out[i] = fold(out[i].(PartialAggregate), p)
+				continue
+			}
+			pending[p.key] = len(out)
+			out = append(out, fold(PartialAggregate{key: p.key, since: p.since}, p))
+			continue
+		}
+		key, ok := a.config.Completed.match(e)
+		if !ok {
+			key, ok = a.config.Expired.match(e)
+		}
+		if i, inFlight := pending[key]; ok && inFlight {
+			out[i] = nil
+			delete(pending, key)
+		}
+		out = append(out, e)
+	}
+	compacted := out[:0]
+	for _, e := range out {
+		if e != nil {
+			compacted = append(compacted, e)
+		}
+	}
+	return compacted
+}
+
+// fold adds the parts of a delta to a partial aggregate. Parts with a higher revision win.
+func fold(p, delta PartialAggregate) PartialAggregate {
+	parts := make(map[string]Event, len(p.parts)+len(delta.parts))
+	for name, e := range p.parts {
+		parts[name] = e
+	}
+	for name, e := range delta.parts {
+		parts[name] = newer(parts[name], e)
+	}
+	return PartialAggregate{key: p.key, since: p.since, parts: parts}
+}
+
+// apply stores the part unless it is outdated or unchanged according to its revision and the policy.
+func (a *Aggregator) apply(storeKey string, e Event, policy CorrectionPolicy) (bool, error) {
+	changed, err := a.changes(storeKey, e, policy)
+	if err != nil || !changed {
+		return false, err
+	}
+	return true, a.store.Put(storeKey, e)
+}
+
+// changes returns if the part changes the stored one according to its revision and the policy.
+func (a *Aggregator) changes(storeKey string, e Event, policy CorrectionPolicy) (bool, error) {
+	prev, ok, err := a.store.Get(storeKey)
+	if err != nil || !ok {
+		return err == nil, err
+	}
+	prevEvent, prevRevision := revisionOf(prev)
+	event, revision := revisionOf(e)
+	switch {
+	case revision < prevRevision:
+		return false, nil
+	case revision == prevRevision && reflect.DeepEqual(event, prevEvent):
+		return false, nil
+	case revision == prevRevision && policy == RejectConflicts:
+		return false, fmt.Errorf("%s revision %d: %w", storeKey, revision, ErrConflictingCorrection)
+	}
+	return true, nil
+}
+
+// amend emits the amended aggregate event for a completed aggregate with the changed part. The
+// part is stored unless the amended aggregate can not be built.
+func (a *Aggregator) amend(key, part string, e Event) error {
+	trigger, _, err := a.store.Get(completedPrefix + key)
+	if err != nil {
+		return err
+	}
+	parts, err := a.parts(key)
+	if err != nil {
+		return err
+	}
+	storeKey := partKey(part, key)
+	if part == a.config.Trigger.name {
+		trigger, storeKey = e, completedPrefix+key
+	}
+	parts[a.config.Trigger.name] = trigger
+	parts[part] = e
+	if filled, ok := a.config.withDefaults(key, parts); ok {
+		parts = filled
+	}
+	if !a.config.isComplete(parts) {
+		return a.store.Put(storeKey, e)
+	}
+	amended, err := a.build(a.config.Amend, key, parts)
+	if err != nil {
+		return err
+	}
+	if err := a.store.Put(storeKey, e); err != nil {
+		return err
+	}
+	a.StateEvents = append(a.StateEvents, amended)
+	return nil
+}
+
+// build adds the default values of missing parts and builds the aggregate event.
+func (a *Aggregator) build(b AggregateBuilder, key string, parts map[string]Event) (Event, error) {
+	if b == nil {
+		return nil, fmt.Errorf("aggregate %q: no builder configured", key)
+	}
+	parts, _ = a.config.withDefaults(key, parts)
+	var missing []string
+	for _, p := range a.config.Parts {
+		if _, ok := parts[p.name]; !ok {
+			missing = append(missing, p.name)
+		}
+	}
+	e, err := b(plain(parts), missing)
+	if err != nil {
+		return nil, fmt.Errorf("aggregate %q: %w", key, err)
+	}
+	return e, nil
+}
+
+// plain returns the parts without their revisions.
+func plain(parts map[string]Event) map[string]Event {
+	p := make(map[string]Event, len(parts))
+	for name, e := range parts {
+		p[name], _ = revisionOf(e)
+	}
+	return p
+}
+
+func (a *Aggregator) time() time.Time {
+	if a.now == nil {
+		return time.Now()
+	}
+	return a.now()
+}
+
+// Expire ends the aggregates in flight that are not completed within the timeout. When the
+// default values complete an aggregate, the completed aggregate event is emitted, otherwise
+// the state event built by the config's Expire function, if any.
+func (a *Aggregator) Expire() error {
+	emitted := len(a.StateEvents)
+	defer func() { a.offset += len(a.StateEvents) - emitted }()
+	if a.config.Timeout <= 0 {
+		return nil
+	}
+	keys, err := a.store.Keys(startedPrefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		started, _, err := a.store.Get(k)
+		if err != nil {
+			return err
+		}
+		s := started.(aggregateStarted)
+		if a.time().Sub(s.at) < a.config.Timeout {
+			continue
+		}
+		parts, err := a.parts(s.key)
+		if err != nil {
+			return err
+		}
+		var completed Event
+		if _, ok := a.config.withDefaults(s.key, parts); ok {
+			completed, _ = a.build(a.config.Complete, s.key, parts) // expired when it fails
+		}
+		if completed != nil {
+			a.StateEvents = append(a.StateEvents, completed)
+			err = a.finish(s.key, true)
+		} else {
+			if a.config.Expire != nil {
+				a.StateEvents = append(a.StateEvents, a.config.Expire(plain(parts)))
+			}
+			err = a.finish(s.key, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish ends an aggregate in flight. Parts other than the trigger are kept for later aggregates.
+// The trigger of a completed aggregate is kept when it can be amended.
+func (a *Aggregator) finish(key string, completed bool) error {
+	trigger, ok, err := a.store.Get(partKey(a.config.Trigger.name, key))
+	if err != nil {
+		return err
+	}
+	if ok && completed && a.config.Amend != nil {
+		if err := a.store.Put(completedPrefix+key, trigger); err != nil {
+			return err
+		}
+	}
+	if err := a.store.Delete(partKey(a.config.Trigger.name, key)); err != nil {
+		return err
+	}
+	return a.store.Delete(startedPrefix + key)
+}
+
+// parts returns the stored parts of an aggregate by name.
+func (a *Aggregator) parts(key string) (map[string]Event, error) {
+	parts := make(map[string]Event)
+	for _, p := range append([]AggregatePart{a.config.Trigger}, a.config.Parts...) {
+		e, ok, err := a.store.Get(partKey(p.name, key))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			parts[p.name] = e
+		}
+	}
+	return parts, nil
+}
+
+// SourceEvents rebuilds the parts and aggregates in flight from source and state events in any order.
+func (a *Aggregator) SourceEvents(events []Event) error {
+	a.offset += len(events)
+	completed := make(map[string]bool) // false when expired
+	triggers := make(map[string]Event) // of completed aggregates to amend
+	for _, e := range events {
+		if key, ok := a.config.Completed.match(e); ok {
+			completed[key] = true
+			continue
+		}
+		if key, ok := a.config.Expired.match(e); ok {
+			if _, exists := completed[key]; !exists {
+				completed[key] = false
+			}
+			continue
+		}
+		switch ev := e.(type) {
+		case PartialAggregate:
+			for part, p := range ev.parts {
+				if _, err := a.apply(partKey(part, ev.key), p, LastWriteWins); err != nil {
+					return err
+				}
+			}
+			// timers continue from the original start instead of the time of sourcing
+			if err := a.store.Put(startedPrefix+ev.key, aggregateStarted{key: ev.key, at: ev.since}); err != nil {
+				return err
+			}
+		default: // triggers are in flight by their state events only
+			part, key, ok := a.config.partOf(e)
+			if !ok {
+				continue
+			}
+			if part == a.config.Trigger.name {
+				triggers[key] = newer(triggers[key], e)
+				continue
+			}
+			if _, err := a.apply(partKey(part, key), e, LastWriteWins); err != nil {
+				return err
+			}
+		}
+	}
+	// cleanup aggregates in flight due to random state events
+	for key, ok := range completed {
+		if err := a.finish(key, ok); err != nil {
+			return err
+		}
+		if trigger, exists := triggers[key]; ok && exists && a.config.Amend != nil {
+			if err := a.store.Put(completedPrefix+key, trigger); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newer returns the event with the higher revision, the last one on a tie.
+func newer(prev, e Event) Event {
+	if prev == nil {
+		return e
+	}
+	_, prevRevision := revisionOf(prev)
+	if _, revision := revisionOf(e); revision < prevRevision {
+		return prev
+	}
+	return e
+}
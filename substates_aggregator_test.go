@@ -0,0 +1,356 @@
+package messaging_spike
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type invoiceRequested struct{ id string }
+type invoiceLine struct{ id, text string }
+type invoiceAddress struct{ id, city string }
+type invoiceSent struct{ id, text, city string }
+
+var invoice = &AggregatorConfig{
+	Trigger: PartOf("request", func(r invoiceRequested) string { return r.id }),
+	Parts: []AggregatePart{
+		PartOf("line", func(l invoiceLine) string { return l.id }),
+		PartOf("address", func(a invoiceAddress) string { return a.id }),
+	},
+	Complete: func(parts map[string]Event, _ []string) (Event, error) {
+		s := invoiceSent{id: parts["request"].(invoiceRequested).id}
+		if l, ok := parts["line"].(invoiceLine); ok {
+			s.text = l.text
+		}
+		if a, ok := parts["address"].(invoiceAddress); ok {
+			s.city = a.city
+		}
+		return s, nil
+	},
+	Completed: PartOf("sent", func(s invoiceSent) string { return s.id }),
+	Timeout:   time.Minute,
+	Expire: func(parts map[string]Event) Event {
+		return invoiceCancelled{parts["request"].(invoiceRequested).id}
+	},
+	Expired: PartOf("cancelled", func(c invoiceCancelled) string { return c.id }),
+}
+
+type invoiceCancelled struct{ id string }
+
+// fixedNow returns a clock that can be moved forward by the test.
+func fixedNow(t *time.Time) func() time.Time {
+	return func() time.Time { return *t }
+}
+
+func TestAggregatorCompletesWithPartsBeforeAndAfterTrigger(t *testing.T) {
+	// given
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := NewAggregator(invoice, NewMemoryStore()).WithClock(fixedNow(&now))
+	events := []Event{
+		invoiceLine{"1", "coffee"},
+		invoiceRequested{"1"},
+		invoiceAddress{"1", "Berlin"},
+	}
+	// when
+	for _, e := range events {
+		if err := a.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// then
+	exp := []Event{
+		PartialAggregate{key: "1", since: now, parts: map[string]Event{"request": events[1], "line": events[0]}},
+		invoiceSent{"1", "coffee", "Berlin"},
+	}
+	if got := a.StateEvents; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestAggregatorRejectsUnknownEvents(t *testing.T) {
+	a := NewAggregator(invoice, NewMemoryStore())
+	if err := a.OnEvent(Coffee{"Alex", "flat white"}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestAggregatorSourcesAggregatesInFlight(t *testing.T) {
+	// given
+	p := NewAggregator(invoice, NewMemoryStore())
+	events := []Event{
+		invoiceRequested{"1"},
+		invoiceLine{"1", "coffee"},
+		invoiceRequested{"2"},
+		invoiceAddress{"2", "Hamburg"},
+		invoiceAddress{"1", "Berlin"},
+	}
+	for _, e := range events {
+		if err := p.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// when
+	s := NewAggregator(invoice, NewMemoryStore())
+	if err := s.SourceEvents(shuffle(append(events, p.StateEvents...)...)); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then the pending invoice completes
+	if err := s.OnEvent(invoiceLine{"2", "tea"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := s.StateEvents, []Event{invoiceSent{"2", "tea", "Hamburg"}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestAggregatorExpiresIncompleteAggregates(t *testing.T) {
+	// given
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	a := NewAggregator(invoice, NewMemoryStore()).WithClock(fixedNow(&now))
+	for _, e := range []Event{invoiceRequested{"1"}, invoiceLine{"1", "coffee"}} {
+		if err := a.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	now = now.Add(30 * time.Second)
+	if err := a.OnEvent(invoiceRequested{"2"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	a.StateEvents = nil
+	// when
+	now = now.Add(30 * time.Second)
+	if err := a.Expire(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then only the first one expired
+	if got, exp := a.StateEvents, []Event{invoiceCancelled{"1"}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+	// and it is evicted while its other parts are kept
+	if _, ok, _ := a.store.Get(partKey("request", "1")); ok {
+		t.Error("expected expired aggregate to be evicted")
+	}
+	if _, ok, _ := a.store.Get(partKey("line", "1")); !ok {
+		t.Error("expected parts to be kept")
+	}
+	// and a late part does not complete it
+	a.StateEvents = nil
+	if err := a.OnEvent(invoiceAddress{"1", "Berlin"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := len(a.StateEvents), 0; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestAggregatorWithoutBuilders(t *testing.T) {
+	// given a config with a timeout but neither Complete nor Expire
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := *invoice
+	c.Complete, c.Expire = nil, nil
+	a := NewAggregator(&c, NewMemoryStore()).WithClock(fixedNow(&now))
+	if err := a.OnEvent(invoiceRequested{"1"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := a.OnEvent(invoiceLine{"1", "coffee"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when complete
+	err := a.OnEvent(invoiceAddress{"1", "Berlin"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// and when expired
+	a.StateEvents = nil
+	now = now.Add(time.Minute)
+	if err := a.Expire(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then it is evicted without state event
+	if got, exp := len(a.StateEvents), 0; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+	if _, ok, _ := a.store.Get(partKey("request", "1")); ok {
+		t.Error("expected expired aggregate to be evicted")
+	}
+}
+
+func TestAggregatorSourcingKeepsTimers(t *testing.T) {
+	// given an aggregate started before a restart
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := NewAggregator(invoice, NewMemoryStore()).WithClock(fixedNow(&now))
+	events := []Event{invoiceRequested{"1"}, invoiceRequested{"2"}, invoiceLine{"2", "tea"}}
+	for _, e := range events {
+		if err := p.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	now = now.Add(time.Minute)
+	if err := p.Expire(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := p.OnEvent(invoiceRequested{"3"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when sourced later
+	now = now.Add(30 * time.Second)
+	s := NewAggregator(invoice, NewMemoryStore()).WithClock(fixedNow(&now))
+	if err := s.SourceEvents(shuffle(append(events, p.StateEvents...)...)); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then expired aggregates stay expired and the timer of the pending one continues
+	if err := s.Expire(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := len(s.StateEvents), 0; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	now = now.Add(30 * time.Second)
+	if err := s.Expire(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := s.StateEvents, []Event{invoiceCancelled{"3"}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestAggregatorCompletionPolicies(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	request, line, address := invoiceRequested{"1"}, invoiceLine{"1", "coffee"}, invoiceAddress{"1", "Berlin"}
+	started := func(parts ...Event) PartialAggregate {
+		p := PartialAggregate{key: "1", since: now, parts: map[string]Event{"request": request}}
+		for _, e := range parts {
+			name, _, _ := invoice.partOf(e)
+			p.parts[name] = e
+		}
+		return p
+	}
+	delta := func(name string, e Event) PartialAggregate {
+		return PartialAggregate{key: "1", since: now, parts: map[string]Event{name: e}}
+	}
+	specs := map[string]struct {
+		policy  CompletionPolicy
+		events  []Event
+		exp     []Event
+		missing []string
+	}{
+		"all of by default": {nil, []Event{request, line, address},
+			[]Event{started(), delta("line", line), invoiceSent{"1", "coffee", "Berlin"}}, nil},
+		"all of": {AllOf("line", "address"), []Event{request, line, address},
+			[]Event{started(), delta("line", line), invoiceSent{"1", "coffee", "Berlin"}}, nil},
+		"any of": {AnyOf(1, "line", "address"), []Event{request, address, line},
+			[]Event{started(), invoiceSent{"1", "", "Berlin"}}, []string{"line"}},
+		"any of before trigger": {AnyOf(1, "line", "address"), []Event{line, request},
+			[]Event{invoiceSent{"1", "coffee", ""}}, []string{"address"}},
+		"predicate": {func(parts map[string]Event) bool {
+			a, ok := parts["address"].(invoiceAddress)
+			return ok && a.city == "Berlin"
+		}, []Event{request, line, address},
+			[]Event{started(), delta("line", line), invoiceSent{"1", "coffee", "Berlin"}}, nil},
+	}
+	for name, spec := range specs {
+		// given
+		var missing []string
+		c := *invoice
+		c.Completion = spec.policy
+		c.Complete = func(parts map[string]Event, m []string) (Event, error) {
+			missing = m
+			return invoice.Complete(parts, m)
+		}
+		a := NewAggregator(&c, NewMemoryStore()).WithClock(fixedNow(&now))
+		// when
+		for _, e := range spec.events {
+			if err := a.OnEvent(e); err != nil {
+				t.Fatalf("%s: unexpected error %s", name, err)
+			}
+		}
+		// then
+		if got, exp := a.StateEvents, spec.exp; !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: expected %#v but got %#v", name, exp, got)
+		}
+		if got, exp := missing, spec.missing; !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: expected missing %v but got %v", name, exp, got)
+		}
+		if _, ok, _ := a.store.Get(partKey("request", "1")); ok {
+			t.Errorf("%s: expected completed aggregate to be removed", name)
+		}
+	}
+}
+
+func TestCoffeeOrderCompletesWithAnyOf(t *testing.T) {
+	// given orders that need sugar or place
+	c := *coffeeOrder
+	c.Completion = AnyOf(1, "sugar", "place")
+	a := NewAggregator(&c, NewMemoryStore())
+	// when the place is missing
+	if err := a.OnEvent(Coffee{"Alex", "flat white"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	err := a.OnEvent(Sugar{"Alex", true})
+	// then the order can not be created
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// and when sugar is missing
+	a.StateEvents = nil
+	for _, e := range []Event{Coffee{"Bob", "Americano"}, Place{"Bob", inHouse}} {
+		if err := a.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// then it is ordered without
+	if got, exp := a.StateEvents[len(a.StateEvents)-1], (OrderCreated{customer: "Bob", kind: "Americano", sugar: false, where: inHouse}); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestAggregatorRetriesPartsWhenBuildFails(t *testing.T) {
+	// given orders that need sugar or place
+	c := *coffeeOrder
+	c.Completion = AnyOf(1, "sugar", "place")
+	a := NewAggregator(&c, NewMemoryStore())
+	if err := a.OnEvent(Coffee{"Alex", "flat white"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := a.OnEvent(Sugar{"Alex", true}); err == nil {
+		t.Fatal("expected error")
+	}
+	// when the part is redelivered
+	err := a.OnEvent(Sugar{"Alex", true})
+	// then it fails again instead of being taken as unchanged
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if _, ok, _ := a.store.Get(partKey("sugar", "Alex")); ok {
+		t.Error("expected the part not to be stored")
+	}
+	if got, exp := len(a.StateEvents), 1; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestAggregatorCompletesWithDefaultsOnTimeout(t *testing.T) {
+	// given
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := NewCoffeeOrderConsumer()
+	c.WithClock(fixedNow(&now))
+	for _, e := range []Event{Coffee{"Alex", "flat white"}, Place{"Alex", inHouse}, Coffee{"Bob", "Americano"}} {
+		if err := c.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	c.StateEvents = nil
+	// when
+	now = now.Add(coffeeOrderTimeout)
+	if err := c.Expire(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then the order without sugar is created and the one without place expired
+	exp := []Event{
+		OrderCreated{customer: "Alex", kind: "flat white", sugar: false, where: inHouse},
+		OrderExpired{customer: "Bob", kind: "Americano"},
+	}
+	if got := c.StateEvents; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
@@ -2,6 +2,7 @@ package messaging_spike
 
 import (
 	"fmt"
+	"time"
 )
 
 // source events
@@ -36,138 +37,70 @@ type OrderCreated struct {
 	where    int
 }
 
-func newOrderCreated(c Coffee, s Sugar, p Place) OrderCreated {
-	return OrderCreated{
-		customer: c.customer,
-		kind:     c.kind,
-		sugar:    s.ordered,
-		where:    p.where,
-	}
-}
+// OrderAmended is emitted when sugar or place of a created order are corrected.
+type OrderAmended OrderCreated
 
-type PartialOrder struct {
+// OrderExpired is emitted when the place of an ordered coffee is not known in time. Without
+// sugar in time, the coffee is ordered without.
+type OrderExpired struct {
 	customer string
-	coffee   *Coffee
-	sugar    *Sugar
-	place    *Place
+	kind     string
 }
 
-// transient state object
-type transientOrder struct {
-	coffee *Coffee
-	sugar  *Sugar
-	place  *Place
-}
+const coffeeOrderTimeout = 15 * time.Minute
 
-func (t *transientOrder) merge(o PartialOrder) {
-	// attributes are only updated once, therefore no overwrite/ merge conflict
-	if o.coffee != nil {
-		t.coffee = o.coffee
-	}
-	if o.sugar != nil {
-		t.sugar = o.sugar
-	}
-	if o.place != nil {
-		t.place = o.place
+// newOrderCreated builds the order from the parts. Sugar is optional, the place is not.
+func newOrderCreated(parts map[string]Event) (OrderCreated, error) {
+	c := parts["coffee"].(Coffee)
+	p, ok := parts["place"].(Place)
+	if !ok {
+		return OrderCreated{}, fmt.Errorf("place of %s missing", c.customer)
 	}
+	s, _ := parts["sugar"].(Sugar)
+	return OrderCreated{
+		customer: c.customer,
+		kind:     c.kind,
+		sugar:    s.ordered,
+		where:    p.where,
+	}, nil
 }
 
-func (t transientOrder) isComplete() bool {
-	return t.coffee != nil && t.sugar != nil && t.place != nil
+var coffeeOrder = &AggregatorConfig{
+	Trigger: PartOf("coffee", func(c Coffee) string { return c.customer }),
+	Parts: []AggregatePart{
+		PartOf("sugar", func(s Sugar) string { return s.customer }),
+		PartOf("place", func(p Place) string { return p.customer }),
+	},
+	Complete: func(parts map[string]Event, _ []string) (Event, error) {
+		return newOrderCreated(parts)
+	},
+	Completed: PartOf("order", func(o OrderCreated) string { return o.customer }),
+	Timeout:   coffeeOrderTimeout,
+	Defaults: map[string]func(string) Event{
+		"sugar": func(customer string) Event { return Sugar{customer: customer, ordered: false} },
+	},
+	Expire: func(parts map[string]Event) Event {
+		c := parts["coffee"].(Coffee)
+		return OrderExpired{customer: c.customer, kind: c.kind}
+	},
+	Expired: PartOf("expired", func(o OrderExpired) string { return o.customer }),
+	Amend: func(parts map[string]Event, _ []string) (Event, error) {
+		o, err := newOrderCreated(parts)
+		return OrderAmended(o), err
+	},
 }
 
-// event consumer
+// event consumer: a coffee order is created when coffee, sugar and place of a customer are known
 type CoffeeOrderConsumer struct {
-	StateEvents    []Event // for simplicity: writing to StateEvents is persisting the event
-	sugarStore     map[string]Sugar
-	placeStore     map[string]Place
-	ordersInFlight map[string]*transientOrder
+	*Aggregator
 }
 
 func NewCoffeeOrderConsumer() *CoffeeOrderConsumer {
-	return &CoffeeOrderConsumer{
-		sugarStore:     make(map[string]Sugar),
-		placeStore:     make(map[string]Place),
-		ordersInFlight: make(map[string]*transientOrder),
-		StateEvents:    make([]Event, 0),
-	}
-}
-
-// process event
-func (c *CoffeeOrderConsumer) OnEvent(e Event) error {
-	switch ev := e.(type) {
-	case Sugar:
-		c.sugarStore[ev.customer] = ev
-		return c.withInFlight(ev.customer, func(t *transientOrder) {
-			t.sugar = &ev
-		})
-	case Place:
-		c.placeStore[ev.customer] = ev
-		return c.withInFlight(ev.customer, func(t *transientOrder) {
-			t.place = &ev
-		})
-	case Coffee:
-		s, sOk := c.sugarStore[ev.customer]
-		p, pOk := c.placeStore[ev.customer]
-		if sOk && pOk { // all dependencies are fulfilled, move on
-			c.StateEvents = append(c.StateEvents, newOrderCreated(ev, s, p))
-			return nil
-		}
-		// store/ persist state
-		c.ordersInFlight[ev.customer] = &transientOrder{}
-		return c.withInFlight(ev.customer, func(t *transientOrder) {
-			t.coffee = &ev
-		})
-	default:
-		return fmt.Errorf("unsupported event: %T", ev)
-	}
-}
-
-func (c *CoffeeOrderConsumer) SourceEvents(events []Event) error {
-	completedOrders := make([]OrderCreated, 0)
-	for _, e := range events {
-		switch ev := e.(type) {
-		case Sugar:
-			c.sugarStore[ev.customer] = ev
-		case Place:
-			c.placeStore[ev.customer] = ev
-		case OrderCreated:
-			completedOrders = append(completedOrders, ev)
-		case PartialOrder:
-			t, ok := c.ordersInFlight[ev.customer]
-			if !ok {
-				t = &transientOrder{}
-				c.ordersInFlight[ev.customer] = t
-			}
-			t.merge(ev)
-		default: // ignore
-		}
-	}
-	// cleanup orders in flight due to random state events
-	for _, e := range completedOrders {
-		if _, ok := c.ordersInFlight[e.customer]; ok {
-			delete(c.ordersInFlight, e.customer)
-		}
-	}
-	return nil
+	return NewCoffeeOrderConsumerWithStore(NewMemoryStore())
 }
 
-func (c *CoffeeOrderConsumer) withInFlight(customer string, merge func(*transientOrder)) error {
-	if i, ok := c.ordersInFlight[customer]; ok {
-		merge(i)
-		if i.isComplete() {
-			c.StateEvents = append(c.StateEvents, newOrderCreated(*i.coffee, *i.sugar, *i.place))
-			delete(c.ordersInFlight, customer)
-			return nil
-		}
-		p := PartialOrder{customer: customer, coffee: i.coffee}
-		if i.place != nil {
-			p.place = i.place
-		}
-		if i.sugar != nil {
-			p.sugar = i.sugar
-		}
-		c.StateEvents = append(c.StateEvents, p)
-	}
-	return nil
+// NewCoffeeOrderConsumerWithStore continues with the state kept in the store, for example
+// after a restart with a FileStore.
+func NewCoffeeOrderConsumerWithStore(s Store) *CoffeeOrderConsumer {
+	return &CoffeeOrderConsumer{NewAggregator(coffeeOrder, s)}
 }
@@ -0,0 +1,86 @@
+package messaging_spike
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// persisted form of an aggregator snapshot
+type snapshot struct {
+	Offset  int                        `json:"offset"`
+	Entries map[string]json.RawMessage `json:"entries"`
+}
+
+// WriteSnapshot writes the parts and aggregates in flight together with the offset of the
+// event log they include.
+func (a *Aggregator) WriteSnapshot(w io.Writer) error {
+	keys, err := a.store.Keys("")
+	if err != nil {
+		return err
+	}
+	s := snapshot{Offset: a.offset, Entries: make(map[string]json.RawMessage, len(keys))}
+	for _, k := range keys {
+		e, _, err := a.store.Get(k)
+		if err != nil {
+			return err
+		}
+		if s.Entries[k], err = encodeEvent(a.codec(), e); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// RestoreSnapshot replaces the state and the offset with the ones of a snapshot and returns
+// the offset.
+func (a *Aggregator) RestoreSnapshot(r io.Reader) (int, error) {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return 0, err
+	}
+	entries := make(map[string]Event, len(s.Entries))
+	for k, rec := range s.Entries {
+		if len(rec) == 0 {
+			return 0, fmt.Errorf("%s: missing event", k)
+		}
+		e, err := decodeEvent(a.codec(), rec)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", k, err)
+		}
+		entries[k] = e
+	}
+	keys, err := a.store.Keys("")
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err := a.store.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	for k, e := range entries {
+		if err := a.store.Put(k, e); err != nil {
+			return 0, err
+		}
+	}
+	a.offset = s.Offset
+	return s.Offset, nil
+}
+
+// codec of the events in snapshots; the coffee order events by default
+func (a *Aggregator) codec() EventCodec {
+	if a.config.Codec == nil {
+		return coffeeOrderCodec{}
+	}
+	return a.config.Codec
+}
+
+// SourceEventsFrom sources the events of the log after the offset of the state, for example
+// of a restored snapshot. The log must be the one the offset counts.
+func (a *Aggregator) SourceEventsFrom(log []Event) error {
+	if len(log) < a.offset {
+		return fmt.Errorf("offset %d out of log of %d events", a.offset, len(log))
+	}
+	return a.SourceEvents(log[a.offset:])
+}
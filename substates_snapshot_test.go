@@ -0,0 +1,91 @@
+package messaging_spike
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResumeFromSnapshot(t *testing.T) {
+	// given a log of source and state events
+	p := NewCoffeeOrderConsumer()
+	var log []Event
+	for _, e := range []Event{
+		Coffee{"Alex", "Flat white"},
+		Sugar{"Alex", false},
+		Sugar{"Bob", true},
+		Place{"Bob", inHouse},
+		Coffee{"Cesar", "Cappucino"},
+		// snapshot
+		Place{"Alex", takeAway},
+		Coffee{"Bob", "Americano"},
+		Sugar{"Cesar", true},
+		Sugar{"Daniel", false},
+	} {
+		if err := p.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		log = append(append(log, e), p.StateEvents...)
+		p.StateEvents = nil
+	}
+	if got, exp := p.Offset(), len(log); got != exp {
+		t.Errorf("expected offset %d but got %d", exp, got)
+	}
+	const offset = 8 // up to the state event of Cesar's coffee
+	if _, ok := log[offset-1].(PartialAggregate); !ok {
+		t.Fatalf("unexpected log %#v", log)
+	}
+	s := NewCoffeeOrderConsumer()
+	if err := s.SourceEvents(log[:offset]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	r := NewCoffeeOrderConsumer()
+	got, err := r.RestoreSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := r.SourceEventsFrom(log); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	if exp := offset; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+	full := NewCoffeeOrderConsumer()
+	if err := full.SourceEvents(log); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !reflect.DeepEqual(r, full) {
+		t.Errorf("expected %#v but got %#v", full.store, r.store)
+	}
+}
+
+func TestRestoreSnapshotReplacesState(t *testing.T) {
+	// given
+	c := NewCoffeeOrderConsumer()
+	if err := c.OnEvent(Sugar{"Alex", true}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	if _, err := c.RestoreSnapshot(strings.NewReader(`{"offset":1,"entries":{"place/Bob":{"type":"Place","customer":"Bob","where":1}}}`)); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	if got, exp := c.store, (&MemoryStore{events: map[string]Event{"place/Bob": Place{"Bob", inHouse}}}); !reflect.DeepEqual(got, Store(exp)) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+	// and the offset of the snapshot
+	if got, exp := c.Offset(), 1; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+	// and logs shorter than the offset are rejected
+	if err := c.SourceEventsFrom(nil); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,387 @@
+package messaging_spike
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps the state of a consumer by key, so that it survives restarts without a replay.
+type Store interface {
+	Get(key string) (Event, bool, error)
+	Put(key string, e Event) error
+	Delete(key string) error
+	Keys(prefix string) ([]string, error) // sorted
+}
+
+// MemoryStore is a Store that lives as long as the process.
+type MemoryStore struct {
+	events map[string]Event
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{events: make(map[string]Event)}
+}
+
+func (s *MemoryStore) Get(key string) (Event, bool, error) {
+	e, ok := s.events[key]
+	return e, ok, nil
+}
+
+func (s *MemoryStore) Put(key string, e Event) error {
+	s.events[key] = e
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	delete(s.events, key)
+	return nil
+}
+
+func (s *MemoryStore) Keys(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	for k := range s.events {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// FileStore is a Store backed by an append-only file of JSON lines. Every change is appended
+// and the file is replayed into memory on open; the last entry of a key wins. After the replay
+// the file is rewritten with the live entries only, so that it does not grow with every change.
+type FileStore struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	codec  EventCodec
+	events *MemoryStore
+}
+
+// persisted form of a store change
+type storeEntry struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Event json.RawMessage `json:"event,omitempty"`
+}
+
+const (
+	putOp    = "put"
+	deleteOp = "delete"
+)
+
+// OpenFileStore opens or creates the file of coffee order events and loads its content.
+func OpenFileStore(path string) (*FileStore, error) {
+	return OpenFileStoreWithCodec(path, coffeeOrderCodec{})
+}
+
+// OpenFileStoreWithCodec opens or creates the file of events encoded by the codec and loads
+// its content.
+func OpenFileStoreWithCodec(path string, c EventCodec) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{f: f, w: bufio.NewWriter(f), codec: c, events: NewMemoryStore()}
+	if err := s.load(); err != nil {
+		return nil, errors.Join(fmt.Errorf("load %s: %v", path, err), f.Close())
+	}
+	if err := s.compact(path); err != nil {
+		return nil, errors.Join(fmt.Errorf("compact %s: %v", path, err), s.f.Close())
+	}
+	return s, nil
+}
+
+// load replays the file. A last line without line break is the partial write of a crash,
+// which was never acknowledged, and is cut off.
+func (s *FileStore) load() error {
+	r := bufio.NewReader(s.f)
+	var offset int64
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(b) == 0 {
+				return nil
+			}
+			return s.f.Truncate(offset)
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(b))
+		var entry storeEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		switch entry.Op {
+		case putOp:
+			if len(entry.Event) == 0 {
+				return fmt.Errorf("line %d: missing event", line)
+			}
+			e, err := decodeEvent(s.codec, entry.Event)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			if err := s.events.Put(entry.Key, e); err != nil {
+				return err
+			}
+		case deleteOp:
+			if err := s.events.Delete(entry.Key); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("line %d: unsupported operation %q", line, entry.Op)
+		}
+	}
+}
+
+// compact writes the live entries to a new file that replaces the one at path.
+func (s *FileStore) compact(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := s.writeEntries(w); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(tmp))
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(tmp))
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(tmp))
+	}
+	old := s.f
+	s.f, s.w = f, w
+	return old.Close()
+}
+
+// writeEntries writes a put entry for every key.
+func (s *FileStore) writeEntries(w *bufio.Writer) error {
+	keys, err := s.events.Keys("")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		e, _, err := s.events.Get(k)
+		if err != nil {
+			return err
+		}
+		b, err := encodeEvent(s.codec, e)
+		if err != nil {
+			return err
+		}
+		if err := writeEntry(w, storeEntry{Op: putOp, Key: k, Event: b}); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (s *FileStore) Get(key string) (Event, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.events.Get(key)
+}
+
+func (s *FileStore) Put(key string, e Event) error {
+	b, err := encodeEvent(s.codec, e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(storeEntry{Op: putOp, Key: key, Event: b}); err != nil {
+		return err
+	}
+	return s.events.Put(key, e)
+}
+
+func (s *FileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok, _ := s.events.Get(key); !ok {
+		return nil
+	}
+	if err := s.append(storeEntry{Op: deleteOp, Key: key}); err != nil {
+		return err
+	}
+	return s.events.Delete(key)
+}
+
+func (s *FileStore) Keys(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.events.Keys(prefix)
+}
+
+// append writes the entry through to the disk.
+func (s *FileStore) append(entry storeEntry) error {
+	if err := writeEntry(s.w, entry); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func writeEntry(w *bufio.Writer, entry storeEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		return errors.Join(err, s.f.Close())
+	}
+	return s.f.Close()
+}
+
+// EventCodec converts the domain events kept by a FileStore or in an aggregator snapshot to
+// JSON and back. The events of the Aggregator around them are encoded by the store.
+type EventCodec interface {
+	Encode(Event) (json.RawMessage, error)
+	Decode(json.RawMessage) (Event, error)
+}
+
+// aggregatorRecord is the JSON form of the events of the Aggregator.
+type aggregatorRecord struct {
+	Type     string                     `json:"type"`
+	Key      string                     `json:"key,omitempty"`   // of a PartialAggregate or AggregateStarted
+	At       time.Time                  `json:"at,omitzero"`     // start of a PartialAggregate or AggregateStarted
+	Parts    map[string]json.RawMessage `json:"parts,omitempty"` // of a PartialAggregate
+	Revision uint                       `json:"revision,omitempty"`
+	Revised  json.RawMessage            `json:"revised,omitempty"` // event of a revision
+}
+
+func encodeEvent(c EventCodec, e Event) (json.RawMessage, error) {
+	switch ev := e.(type) {
+	case Revised:
+		r, err := encodeEvent(c, ev.event)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(aggregatorRecord{Type: "Revised", Revision: ev.revision, Revised: r})
+	case aggregateStarted:
+		return json.Marshal(aggregatorRecord{Type: "AggregateStarted", Key: ev.key, At: ev.at})
+	case PartialAggregate:
+		r := aggregatorRecord{Type: "PartialAggregate", Key: ev.key, At: ev.since, Parts: make(map[string]json.RawMessage, len(ev.parts))}
+		for name, p := range ev.parts {
+			var err error
+			if r.Parts[name], err = encodeEvent(c, p); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(r)
+	default:
+		return c.Encode(e)
+	}
+}
+
+func decodeEvent(c EventCodec, data json.RawMessage) (Event, error) {
+	var r aggregatorRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	switch r.Type {
+	case "Revised":
+		if len(r.Revised) == 0 {
+			return nil, fmt.Errorf("missing revised event")
+		}
+		e, err := decodeEvent(c, r.Revised)
+		if err != nil {
+			return nil, err
+		}
+		return Revise(e, r.Revision), nil
+	case "AggregateStarted":
+		return aggregateStarted{key: r.Key, at: r.At}, nil
+	case "PartialAggregate":
+		p := PartialAggregate{key: r.Key, since: r.At, parts: make(map[string]Event, len(r.Parts))}
+		for name, pr := range r.Parts {
+			if len(pr) == 0 {
+				return nil, fmt.Errorf("missing part %q", name)
+			}
+			e, err := decodeEvent(c, pr)
+			if err != nil {
+				return nil, err
+			}
+			p.parts[name] = e
+		}
+		return p, nil
+	default:
+		return c.Decode(data)
+	}
+}
+
+// coffeeOrderCodec is the EventCodec of the coffee order events.
+type coffeeOrderCodec struct{}
+
+// JSON form of the coffee order events
+type coffeeOrderRecord struct {
+	Type     string `json:"type"`
+	Customer string `json:"customer,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	Sugar    bool   `json:"sugar,omitempty"`
+	Where    int    `json:"where,omitempty"`
+}
+
+func (coffeeOrderCodec) Encode(e Event) (json.RawMessage, error) {
+	var r coffeeOrderRecord
+	switch ev := e.(type) {
+	case Coffee:
+		r = coffeeOrderRecord{Type: "Coffee", Customer: ev.customer, Kind: ev.kind}
+	case Sugar:
+		r = coffeeOrderRecord{Type: "Sugar", Customer: ev.customer, Sugar: ev.ordered}
+	case Place:
+		r = coffeeOrderRecord{Type: "Place", Customer: ev.customer, Where: ev.where}
+	case OrderCreated:
+		r = coffeeOrderRecord{Type: "OrderCreated", Customer: ev.customer, Kind: ev.kind, Sugar: ev.sugar, Where: ev.where}
+	case OrderAmended:
+		r = coffeeOrderRecord{Type: "OrderAmended", Customer: ev.customer, Kind: ev.kind, Sugar: ev.sugar, Where: ev.where}
+	case OrderExpired:
+		r = coffeeOrderRecord{Type: "OrderExpired", Customer: ev.customer, Kind: ev.kind}
+	default:
+		return nil, fmt.Errorf("unsupported event: %T", ev)
+	}
+	return json.Marshal(r)
+}
+
+func (coffeeOrderCodec) Decode(data json.RawMessage) (Event, error) {
+	var r coffeeOrderRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	switch r.Type {
+	case "Coffee":
+		return Coffee{customer: r.Customer, kind: r.Kind}, nil
+	case "Sugar":
+		return Sugar{customer: r.Customer, ordered: r.Sugar}, nil
+	case "Place":
+		return Place{customer: r.Customer, where: r.Where}, nil
+	case "OrderCreated":
+		return OrderCreated{customer: r.Customer, kind: r.Kind, sugar: r.Sugar, where: r.Where}, nil
+	case "OrderAmended":
+		return OrderAmended{customer: r.Customer, kind: r.Kind, sugar: r.Sugar, where: r.Where}, nil
+	case "OrderExpired":
+		return OrderExpired{customer: r.Customer, kind: r.Kind}, nil
+	default:
+		return nil, fmt.Errorf("unsupported event type %q", r.Type)
+	}
+}
@@ -0,0 +1,300 @@
+package messaging_spike
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closeStore closes the store when the test ends.
+func closeStore(t *testing.T, s *FileStore) {
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("unexpected error %s", err)
+		}
+	})
+}
+
+func TestFileStoreReloadsLatestEntries(t *testing.T) {
+	// given
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	coffee := Coffee{"Alex", "flat white"}
+	for _, op := range []func() error{
+		func() error { return s.Put("sugar/Alex", Sugar{"Alex", false}) },
+		func() error { return s.Put("sugar/Alex", Revise(Sugar{"Alex", true}, 1)) },
+		func() error { return s.Put("place/Bob", Place{"Bob", inHouse}) },
+		func() error { return s.Delete("place/Bob") },
+		func() error {
+			return s.Put("order/Alex", PartialAggregate{key: "Alex", parts: map[string]Event{"coffee": coffee}})
+		},
+	} {
+		if err := op(); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	closeStore(t, s)
+	// then
+	for key, exp := range map[string]Event{
+		"sugar/Alex": Revise(Sugar{"Alex", true}, 1),
+		"order/Alex": PartialAggregate{key: "Alex", parts: map[string]Event{"coffee": coffee}},
+	} {
+		got, ok, err := s.Get(key)
+		if err != nil || !ok {
+			t.Fatalf("%s: expected entry but got %v, %v", key, ok, err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: expected %#v but got %#v", key, exp, got)
+		}
+	}
+	if _, ok, _ := s.Get("place/Bob"); ok {
+		t.Error("expected deleted entry to be gone")
+	}
+}
+
+func TestFileStoreRewritesLiveEntriesOnOpen(t *testing.T) {
+	// given a file with overwritten and deleted entries
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, op := range []func() error{
+		func() error { return s.Put("sugar/Alex", Sugar{"Alex", false}) },
+		func() error { return s.Put("sugar/Alex", Sugar{"Alex", true}) },
+		func() error { return s.Put("place/Bob", Place{"Bob", inHouse}) },
+		func() error { return s.Delete("place/Bob") },
+	} {
+		if err := op(); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	if s, err = OpenFileStore(path); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	closeStore(t, s)
+	// then
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := string(b), `{"op":"put","key":"sugar/Alex","event":{"type":"Sugar","customer":"Alex","sugar":true}}`+"\n"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	// and changes are appended to the new file
+	if err := s.Delete("sugar/Alex"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if b, _ = os.ReadFile(path); !strings.HasSuffix(string(b), `{"op":"delete","key":"sugar/Alex"}`+"\n") {
+		t.Errorf("expected delete entry but got %q", b)
+	}
+}
+
+func TestFileStoreRejectsCorruptFile(t *testing.T) {
+	// given
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	if err := os.WriteFile(path, []byte(`{"op":"put","key":"x","event":{"type":"Tea"}}`+"\n"), 0644); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	_, err := OpenFileStore(path)
+	// then
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPartialOrdersSurviveRestart(t *testing.T) {
+	// given a consumer with an order in flight
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	c := NewCoffeeOrderConsumerWithStore(s)
+	for _, e := range []Event{Sugar{"Alex", true}, Coffee{"Alex", "flat white"}} {
+		if err := c.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when restarted without replay
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	closeStore(t, s)
+	c = NewCoffeeOrderConsumerWithStore(s)
+	if err := c.OnEvent(Place{"Alex", takeAway}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	if got, exp := len(c.StateEvents), 1; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	exp := OrderCreated{customer: "Alex", kind: "flat white", sugar: true, where: takeAway}
+	if got := c.StateEvents[0]; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+	if _, ok, _ := s.Get(partKey("coffee", "Alex")); ok {
+		t.Error("expected completed order to be removed")
+	}
+}
+
+func TestExpiredOrdersAcrossRestart(t *testing.T) {
+	// given an order in flight persisted in a file
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := NewCoffeeOrderConsumerWithStore(s)
+	c.WithClock(fixedNow(&now))
+	if err := c.OnEvent(Coffee{"Alex", "flat white"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when restarted after the timeout
+	if s, err = OpenFileStore(path); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	closeStore(t, s)
+	now = now.Add(coffeeOrderTimeout)
+	c = NewCoffeeOrderConsumerWithStore(s)
+	c.WithClock(fixedNow(&now))
+	if err := c.Expire(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	exp := []Event{OrderExpired{customer: "Alex", kind: "flat white"}}
+	if got := c.StateEvents; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+	if keys, _ := s.Keys(""); len(keys) != 0 {
+		t.Errorf("expected empty store but got %v", keys)
+	}
+}
+
+func TestFileStoreCutsOffPartialLastLine(t *testing.T) {
+	// given a file with a write torn by a crash
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	content := `{"op":"put","key":"sugar/Alex","event":{"type":"Sugar","customer":"Alex","sugar":true}}` + "\n" + `{"op":"put","key":"pla`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := s.Put("place/Alex", Place{"Alex", inHouse}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then the complete entries are kept
+	if s, err = OpenFileStore(path); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	closeStore(t, s)
+	if got, exp := s.events.events, map[string]Event{"sugar/Alex": Sugar{"Alex", true}, "place/Alex": Place{"Alex", inHouse}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestFileStoreWithCodecKeepsOtherAggregates(t *testing.T) {
+	// given
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	s, err := OpenFileStoreWithCodec(path, invoiceCodec{})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	a := NewAggregator(invoice, s)
+	for _, e := range []Event{invoiceRequested{"1"}, invoiceLine{"1", "coffee"}} {
+		if err := a.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when restarted
+	if s, err = OpenFileStoreWithCodec(path, invoiceCodec{}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	closeStore(t, s)
+	a = NewAggregator(invoice, s)
+	if err := a.OnEvent(invoiceAddress{"1", "Berlin"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	if got, exp := a.StateEvents, []Event{invoiceSent{"1", "coffee", "Berlin"}}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+// invoiceCodec encodes the invoice events of the aggregator tests.
+type invoiceCodec struct{}
+
+type invoiceRecord struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Text string `json:"text,omitempty"`
+	City string `json:"city,omitempty"`
+}
+
+func (invoiceCodec) Encode(e Event) (json.RawMessage, error) {
+	switch ev := e.(type) {
+	case invoiceRequested:
+		return json.Marshal(invoiceRecord{Type: "requested", ID: ev.id})
+	case invoiceLine:
+		return json.Marshal(invoiceRecord{Type: "line", ID: ev.id, Text: ev.text})
+	case invoiceAddress:
+		return json.Marshal(invoiceRecord{Type: "address", ID: ev.id, City: ev.city})
+	default:
+		return nil, fmt.Errorf("unsupported event: %T", e)
+	}
+}
+
+func (invoiceCodec) Decode(data json.RawMessage) (Event, error) {
+	var r invoiceRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	switch r.Type {
+	case "requested":
+		return invoiceRequested{r.ID}, nil
+	case "line":
+		return invoiceLine{r.ID, r.Text}, nil
+	case "address":
+		return invoiceAddress{r.ID, r.City}, nil
+	default:
+		return nil, fmt.Errorf("unsupported event type %q", r.Type)
+	}
+}
@@ -1,6 +1,7 @@
 package messaging_spike
 
 import (
+	"errors"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -91,3 +92,182 @@ func shuffle(a ...Event) []Event {
 	}
 	return a
 }
+
+func TestCorrectionsOfCreatedOrders(t *testing.T) {
+	// given a created order
+	o := NewCoffeeOrderConsumer()
+	for _, e := range []Event{Coffee{"Alex", "flat white"}, Sugar{"Alex", false}, Place{"Alex", takeAway}} {
+		if err := o.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	o.StateEvents = nil
+	// when
+	for _, e := range []Event{
+		Sugar{"Alex", true},                // last write wins
+		Sugar{"Alex", true},                // duplicate
+		Revise(Place{"Alex", inHouse}, 2),  // versioned correction
+		Revise(Place{"Alex", takeAway}, 1), // outdated
+	} {
+		if err := o.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	// then
+	exp := []Event{
+		OrderAmended{customer: "Alex", kind: "flat white", sugar: true, where: takeAway},
+		OrderAmended{customer: "Alex", kind: "flat white", sugar: true, where: inHouse},
+	}
+	if got := o.StateEvents; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestRejectConflictingCorrections(t *testing.T) {
+	// given
+	c := *coffeeOrder
+	c.Corrections = RejectConflicts
+	o := NewAggregator(&c, NewMemoryStore())
+	if err := o.OnEvent(Sugar{"Alex", false}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when changed without a new revision
+	err := o.OnEvent(Sugar{"Alex", true})
+	// then
+	if !errors.Is(err, ErrConflictingCorrection) {
+		t.Errorf("expected %v but got %v", ErrConflictingCorrection, err)
+	}
+	// when changed with a new revision
+	if err := o.OnEvent(Revise(Sugar{"Alex", true}, 1)); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	got, _, _ := o.store.Get(partKey("sugar", "Alex"))
+	if exp := Revise(Sugar{"Alex", true}, 1); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestSourcedOrdersCanBeAmended(t *testing.T) {
+	// given
+	events := []Event{Sugar{"Alex", false}, Place{"Alex", takeAway}, Coffee{"Alex", "flat white"}}
+	p := NewCoffeeOrderConsumer()
+	for _, e := range events {
+		if err := p.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	s := NewCoffeeOrderConsumer()
+	if err := s.SourceEvents(shuffle(append(events, p.StateEvents...)...)); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	if err := s.OnEvent(Place{"Alex", inHouse}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	exp := []Event{OrderAmended{customer: "Alex", kind: "flat white", sugar: false, where: inHouse}}
+	if got := s.StateEvents; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestOrdersSourcedFromStateEventsCanBeAmended(t *testing.T) {
+	// given a log where the coffee is only in the partial order, as after a snapshot
+	p := NewCoffeeOrderConsumer()
+	for _, e := range []Event{Coffee{"Alex", "flat white"}, Sugar{"Alex", false}, Place{"Alex", takeAway}} {
+		if err := p.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	s := NewCoffeeOrderConsumer()
+	if err := s.SourceEvents(p.StateEvents); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// when
+	if err := s.OnEvent(Place{"Alex", inHouse}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then
+	exp := []Event{OrderAmended{customer: "Alex", kind: "flat white", sugar: false, where: inHouse}}
+	if got := s.StateEvents; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestPartialOrdersAreDeltas(t *testing.T) {
+	// given
+	o := NewCoffeeOrderConsumer()
+	// when
+	for _, e := range []Event{Sugar{"Alex", true}, Coffee{"Alex", "flat white"}, Place{"Alex", takeAway}} {
+		if err := o.OnEvent(e); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if err := o.OnEvent(Coffee{"Bob", "Americano"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := o.OnEvent(Sugar{"Bob", false}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then the first partial order holds all parts so far, the following the change only
+	s := o.StateEvents
+	if got, exp := len(s), 4; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	if got, exp := s[0].(PartialAggregate).parts, (map[string]Event{"coffee": Coffee{"Alex", "flat white"}, "sugar": Sugar{"Alex", true}}); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+	if got, exp := s[3].(PartialAggregate).parts, (map[string]Event{"sugar": Sugar{"Bob", false}}); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %#v but got %#v", exp, got)
+	}
+}
+
+func TestCompactedStateEventsSourceTheSameState(t *testing.T) {
+	for i := 0; i < 100; i++ { // run test multiple times
+		// given
+		events := []Event{
+			Coffee{"Alex", "Flat white"},
+			Sugar{"Alex", false},
+			Place{"Alex", takeAway},
+			Coffee{"Bob", "Americano"},
+			Sugar{"Bob", true},
+			Revise(Sugar{"Bob", false}, 1),
+			Coffee{"Cesar", "Cappucino"},
+			Place{"Cesar", inHouse},
+			Sugar{"Daniel", false},
+		}
+		p := NewCoffeeOrderConsumer()
+		for _, e := range events {
+			if err := p.OnEvent(e); err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+		}
+		// when
+		compacted := p.Compact(p.StateEvents)
+		// then only one partial order per order in flight is left
+		exp := []Event{
+			OrderCreated{customer: "Alex", kind: "Flat white", sugar: false, where: takeAway},
+			PartialAggregate{key: "Bob", since: compacted[1].(PartialAggregate).since, parts: map[string]Event{
+				"coffee": Coffee{"Bob", "Americano"}, "sugar": Revise(Sugar{"Bob", false}, 1),
+			}},
+			PartialAggregate{key: "Cesar", since: compacted[2].(PartialAggregate).since, parts: map[string]Event{
+				"coffee": Coffee{"Cesar", "Cappucino"}, "place": Place{"Cesar", inHouse},
+			}},
+		}
+		if got := compacted; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected %#v but got %#v", exp, got)
+		}
+		// and sourcing restores the same state
+		full, s := NewCoffeeOrderConsumer(), NewCoffeeOrderConsumer()
+		if err := full.SourceEvents(shuffle(append(events, p.StateEvents...)...)); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if err := s.SourceEvents(shuffle(append(events, compacted...)...)); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if got, exp := s.store, full.store; !reflect.DeepEqual(got, exp) {
+			t.Errorf("expected %#v but got %#v", exp, got)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package messaging_spike
 
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
 const (
 	A = iota
 	B
@@ -104,6 +110,38 @@ func (v VectorClock) Equals(o VectorClock) bool {
 	return true
 }
 
+// Descends compares all tick values. It is true when no tick of given clock is ahead.
+func (v VectorClock) Descends(o VectorClock) bool {
+	for k, n := range o.clocks {
+		if v.clocks[k] < n {
+			return false
+		}
+	}
+	return true
+}
+
+// Concurrent is true when both clocks have ticks the other one has not seen.
+func (v VectorClock) Concurrent(o VectorClock) bool {
+	return !v.Descends(o) && !o.Descends(v)
+}
+
+func (v VectorClock) sum() uint64 {
+	var s uint64
+	for _, n := range v.clocks {
+		s += n
+	}
+	return s
+}
+
+// String formats the clock as its name followed by the ticks, e.g. "1:[0:2 1:5]".
+func (v VectorClock) String() string {
+	return fmt.Sprintf("%d:%s", v.name, strings.TrimPrefix(fmt.Sprint(v.clocks), "map"))
+}
+
+func (v VectorClock) LogValue() slog.Value {
+	return slog.StringValue(v.String())
+}
+
 func (v VectorClock) IsSameType(o VectorClock) bool {
 	return v.name == o.name
 }
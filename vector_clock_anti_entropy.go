@@ -0,0 +1,86 @@
+package messaging_spike
+
+// Anti entropy: replicas that diverged, for example during a network partition, reconcile by
+// periodically exchanging their vector clocks (digests). The replica that is ahead transfers
+// its state; concurrent states are resolved deterministically by both sides.
+
+// Digest is the clock a replica sends to a peer in an anti entropy round.
+func (f *VCModel) Digest() VectorClock {
+	return f.vectorClock
+}
+
+func (f *VCModel) replicaState() VCMessage {
+	return VCMessage{vectorClock: f.vectorClock, newState: f.state}
+}
+
+// OnDigest compares the clock of a peer with the own one. It tells whether the peer misses
+// state of this replica (push) or this replica misses state of the peer (pull).
+func (f *VCModel) OnDigest(peer VectorClock) (push, pull bool) {
+	switch ahead, behind := f.vectorClock.Descends(peer), peer.Descends(f.vectorClock); {
+	case ahead && behind:
+		return false, false
+	case behind:
+		return false, true
+	default: // ahead or concurrent; the peer resolves a conflict and pushes the result back
+		return true, false
+	}
+}
+
+// OnState applies the state of a peer replica when it is ahead or wins a conflict. It returns
+// true when the peer is not up to date with this replica afterwards and should get its state.
+func (f *VCModel) OnState(peer VCMessage) bool {
+	ahead, behind := f.vectorClock.Descends(peer.vectorClock), peer.vectorClock.Descends(f.vectorClock)
+	switch {
+	case ahead && behind:
+		return false
+	case behind:
+		f.state = peer.newState
+	case !ahead: // concurrent
+		f.state = resolveConflict(f.replicaState(), peer).newState
+	}
+	f.vectorClock = f.vectorClock.Merge(peer.vectorClock)
+	return !peer.vectorClock.Descends(f.vectorClock)
+}
+
+// resolveConflict picks the same winner of two concurrent states on every replica: the one
+// with more ticks or, on a tie, the greater state value.
+func resolveConflict(a, b VCMessage) VCMessage {
+	as, bs := a.vectorClock.sum(), b.vectorClock.sum()
+	if as > bs || (as == bs && a.newState >= b.newState) {
+		return a
+	}
+	return b
+}
+
+// GossipRound lets every node send its digest to a random peer.
+func (s *Simulation) GossipRound() {
+	if len(s.nodes) < 2 {
+		return
+	}
+	for from, n := range s.nodes {
+		to := s.rnd.Intn(len(s.nodes) - 1)
+		if to >= from {
+			to++
+		}
+		s.enqueue(link{from, to}, digestDelivery, VCMessage{vectorClock: n.Digest()})
+	}
+}
+
+// RunAntiEntropy runs the given number of gossip rounds, one every interval ticks.
+func (s *Simulation) RunAntiEntropy(rounds int, interval uint64) {
+	for i := 0; i < rounds; i++ {
+		s.GossipRound()
+		s.RunUntil(s.now + interval)
+	}
+}
+
+// Converged is true when all nodes have the same state and have seen the same ticks.
+func (s *Simulation) Converged() bool {
+	first := s.nodes[0]
+	for _, n := range s.nodes[1:] {
+		if n.state != first.state || !n.vectorClock.Descends(first.vectorClock) || !first.vectorClock.Descends(n.vectorClock) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package messaging_spike
+
+import "testing"
+
+func TestAntiEntropyConvergesAfterPartition(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		// given two sides of a partition receive different updates
+		s := NewSimulation(seed, 4, LinkConfig{MinDelay: 1, MaxDelay: 5})
+		s.Partition([]int{0, 1}, []int{2, 3})
+		if err := s.Send(0, 1, "left"); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if err := s.Send(2, 3, "right"); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		s.Run()
+		// and the network gets unreliable
+		for from := 0; from < 4; from++ {
+			for to := 0; to < 4; to++ {
+				s.SetLink(from, to, LinkConfig{MinDelay: 1, MaxDelay: 5, DropRate: 0.2, DuplicateRate: 0.1})
+			}
+		}
+		s.RunAntiEntropy(10, 10)
+		if s.Converged() {
+			t.Fatalf("seed %d: should not converge while partitioned", seed)
+		}
+
+		// when
+		s.Heal()
+		s.RunAntiEntropy(50, 10)
+
+		// then
+		if !s.Converged() {
+			t.Fatalf("seed %d: not converged: %v", seed, s.Trace)
+		}
+		for i := 0; i < 4; i++ {
+			if got, exp := s.Node(i).state, "right"; got != exp {
+				t.Errorf("seed %d: node %d: expected %q but got %q", seed, i, exp, got)
+			}
+		}
+	}
+}
+
+func TestDigestDetectsWhoIsBehind(t *testing.T) {
+	// given
+	a, b, c := NewVCModel(A), NewVCModel(B), NewVCModel(C)
+	if err := a.SendTo(b, "a1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := c.SendTo(a, "c1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	for name, spec := range map[string]struct {
+		replica, peer *VCModel
+		push, pull    bool
+	}{
+		"equal":      {b, b, false, false},
+		"ahead":      {b, NewVCModel(C), true, false},
+		"behind":     {NewVCModel(C), b, false, true},
+		"concurrent": {a, b, true, false},
+	} {
+		// when
+		push, pull := spec.replica.OnDigest(spec.peer.Digest())
+		// then
+		if push != spec.push || pull != spec.pull {
+			t.Errorf("%s: expected push %v, pull %v but got %v, %v", name, spec.push, spec.pull, push, pull)
+		}
+	}
+}
+
+func TestOnStateResolvesConflictsOnBothSides(t *testing.T) {
+	// given two replicas with concurrent updates
+	a, b, c := NewVCModel(A), NewVCModel(B), NewVCModel(C)
+	if err := c.SendTo(a, "first"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := c.SendTo(b, "second"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !a.Digest().Concurrent(b.Digest()) {
+		t.Fatal("expected concurrent clocks")
+	}
+
+	// when
+	pushBack := b.OnState(a.replicaState())
+	// then
+	if !pushBack {
+		t.Fatal("expected resolved state to be pushed back")
+	}
+	if a.OnState(b.replicaState()) {
+		t.Error("expected no further push")
+	}
+	if a.state != b.state || a.state != "second" {
+		t.Errorf("expected both replicas with %q but got %q and %q", "second", a.state, b.state)
+	}
+	if !a.Digest().Descends(b.Digest()) || !b.Digest().Descends(a.Digest()) {
+		t.Errorf("expected same ticks but got %v and %v", a.Digest(), b.Digest())
+	}
+}
@@ -0,0 +1,147 @@
+package messaging_spike
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrCausalBufferFull = errors.New("causal buffer full. too many messages waiting for predecessors")
+
+type bufferedMessage struct {
+	msg   VCMessage
+	since time.Time
+}
+
+// CausalReceiver wraps a Receiver and delivers messages in causal order. A message waits in a
+// buffer until the previous message of its producer and all ticks of other producers it
+// carries were delivered. As the producer's own clock entry also counts its receives, the
+// messages of a producer are ordered by their send sequence. Producers are expected to
+// broadcast every message to all receivers. The buffer is limited and messages waiting too
+// long can be expired.
+type CausalReceiver struct {
+	r         Receiver
+	name      int            // name of the wrapped receiver; its own ticks are never missing
+	delivered VectorClock    // ticks of all messages delivered so far
+	sequences map[int]uint64 // last send sequence delivered by producer
+	buffer    []bufferedMessage
+	limit     int
+	timeout   time.Duration
+	now       func() time.Time
+}
+
+func NewCausalReceiver(name int, r Receiver, limit int, timeout time.Duration) *CausalReceiver {
+	return &CausalReceiver{
+		r:         r,
+		name:      name,
+		delivered: NewVectorClock(name),
+		sequences: make(map[int]uint64),
+		limit:     limit,
+		timeout:   timeout,
+		now:       time.Now,
+	}
+}
+
+// WithClock replaces time.Now to measure how long messages wait.
+func (c *CausalReceiver) WithClock(now func() time.Time) *CausalReceiver {
+	c.now = now
+	return c
+}
+
+// Receive delivers the message and all buffered ones that depend on it. It returns the
+// errors of the wrapped Receiver for every message delivered.
+func (c *CausalReceiver) Receive(msg VCMessage) error {
+	if !c.deliverable(msg) {
+		if c.buffered(msg) { // redelivered while waiting
+			return nil
+		}
+		if len(c.buffer) >= c.limit {
+			return ErrCausalBufferFull
+		}
+		c.buffer = append(c.buffer, bufferedMessage{msg: msg, since: c.now()})
+		return nil
+	}
+	errs := []error{c.deliver(msg)}
+	for i := c.next(); i >= 0; i = c.next() {
+		m := c.buffer[i].msg
+		c.buffer = append(c.buffer[:i], c.buffer[i+1:]...)
+		errs = append(errs, c.deliver(m))
+	}
+	return errors.Join(errs...)
+}
+
+// Pending returns the number of messages waiting for predecessors.
+func (c *CausalReceiver) Pending() int {
+	return len(c.buffer)
+}
+
+// Expire drops the messages that waited longer than the timeout for missing predecessors
+// and returns them, so that they can be requested again or reported. The missing messages of
+// their producers are given up: later messages of the producers do not wait for them.
+func (c *CausalReceiver) Expire() []VCMessage {
+	var expired []VCMessage
+	kept := c.buffer[:0]
+	for _, b := range c.buffer {
+		if c.now().Sub(b.since) > c.timeout {
+			expired = append(expired, b.msg)
+			if producer := b.msg.vectorClock.name; b.msg.seq > c.sequences[producer] {
+				c.sequences[producer] = b.msg.seq
+			}
+			continue
+		}
+		kept = append(kept, b)
+	}
+	c.buffer = kept
+	return expired
+}
+
+// buffered is true when a message with the same producer and send sequence waits already.
+func (c *CausalReceiver) buffered(msg VCMessage) bool {
+	for _, b := range c.buffer {
+		if b.msg.vectorClock.name == msg.vectorClock.name && b.msg.seq == msg.seq {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver counts the message as delivered once the wrapped receiver accepted it.
+func (c *CausalReceiver) deliver(msg VCMessage) error {
+	if err := c.r.Receive(msg); err != nil {
+		return err
+	}
+	c.delivered = c.delivered.Merge(msg.vectorClock)
+	if producer := msg.vectorClock.name; msg.seq > c.sequences[producer] {
+		c.sequences[producer] = msg.seq
+	}
+	return nil
+}
+
+// deliverable is true when the message is the next one of its producer and all ticks of other
+// producers it depends on were delivered. Messages delivered before are passed on, so that the
+// wrapped receiver reports them.
+func (c *CausalReceiver) deliverable(msg VCMessage) bool {
+	producer := msg.vectorClock.name
+	if msg.seq > c.sequences[producer]+1 {
+		return false
+	}
+	for k, n := range msg.vectorClock.clocks {
+		if k == producer || k == c.name {
+			continue
+		}
+		if d, _ := c.delivered.Get(k); d < n {
+			return false
+		}
+	}
+	return true
+}
+
+// next returns the index of the deliverable buffered message with the lowest send sequence or -1.
+func (c *CausalReceiver) next() int {
+	found := -1
+	for i, b := range c.buffer {
+		if c.deliverable(b.msg) && (found < 0 || b.msg.seq < c.buffer[found].msg.seq) {
+			found = i
+		}
+	}
+	return found
+}
@@ -0,0 +1,250 @@
+package messaging_spike
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCausalReceiverWaitsForPredecessors(t *testing.T) {
+	// given a broadcasts m1 to b and c; b sends m2 to c after seeing m1
+	a, b, c := NewVCModel(A), NewVCModel(B), NewVCModel(C)
+	toC := &recordingReceiver{}
+	if err := a.SendTo(multiReceiver{b, toC}, "m1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := b.SendTo(toC, "m2"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	m1, m2 := toC.received[0], toC.received[1]
+	causal := NewCausalReceiver(C, c, 10, time.Minute)
+
+	// when m2 overtakes m1
+	if err := causal.Receive(m2); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// then it waits
+	if got, exp := c.state, ""; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := causal.Pending(), 1; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+
+	// and when m1 arrives both are delivered in causal order
+	if err := causal.Receive(m1); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := c.state, "m2"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := causal.Pending(), 0; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestCausalReceiverOrdersMessagesOfOneProducer(t *testing.T) {
+	// given
+	a, b := NewVCModel(A), NewVCModel(B)
+	captured := &recordingReceiver{}
+	if err := a.SendTo(captured, "a1", "a2", "a3"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	causal := NewCausalReceiver(B, b, 10, time.Minute)
+
+	// when the messages arrive in reverse order
+	for i := len(captured.received) - 1; i >= 0; i-- {
+		if err := causal.Receive(captured.received[i]); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+
+	// then all are delivered in order
+	if got, exp := b.state, "a3"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := b.Clock(A), 3; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+	if got, exp := causal.Pending(), 0; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestCausalReceiverCountsAcceptedMessagesOnly(t *testing.T) {
+	// given
+	a := NewVCModel(A)
+	captured := &recordingReceiver{}
+	if err := a.SendTo(captured, "a1", "a2"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	r := &failingReceiver{failures: 1}
+	causal := NewCausalReceiver(B, r, 10, time.Minute)
+
+	// when the first message is rejected
+	if err := causal.Receive(captured.received[0]); err == nil {
+		t.Fatal("expected error")
+	}
+	// then its successor waits
+	if err := causal.Receive(captured.received[1]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := len(r.received), 0; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	// and both are delivered when the first one is received again
+	if err := causal.Receive(captured.received[0]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if got, exp := len(r.received), 2; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestCausalReceiverIsBounded(t *testing.T) {
+	// given
+	a, b := NewVCModel(A), NewVCModel(B)
+	captured := &recordingReceiver{}
+	if err := a.SendTo(b, "a1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := b.SendTo(captured, "b1", "b2"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	causal := NewCausalReceiver(C, NewVCModel(C), 1, time.Minute)
+
+	// when
+	if err := causal.Receive(captured.received[0]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	err := causal.Receive(captured.received[1])
+
+	// then
+	if err != ErrCausalBufferFull {
+		t.Errorf("expected %v but got %v", ErrCausalBufferFull, err)
+	}
+}
+
+func TestCausalReceiverExpiresMissingPredecessors(t *testing.T) {
+	// given
+	a, b := NewVCModel(A), NewVCModel(B)
+	captured := &recordingReceiver{}
+	if err := a.SendTo(b, "a1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := b.SendTo(captured, "b1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	causal := NewCausalReceiver(C, NewVCModel(C), 10, time.Minute).WithClock(func() time.Time { return now })
+	if err := causal.Receive(captured.received[0]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// when
+	if got := causal.Expire(); len(got) != 0 {
+		t.Fatalf("expected nothing expired but got %v", got)
+	}
+	now = now.Add(2 * time.Minute)
+	expired := causal.Expire()
+
+	// then
+	if got, exp := len(expired), 1; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	if got, exp := expired[0].newState, "b1"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := causal.Pending(), 0; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestCausalReceiverBuffersRedeliveredMessagesOnce(t *testing.T) {
+	// given
+	a := NewVCModel(A)
+	captured := &recordingReceiver{}
+	if err := a.SendTo(captured, "a1", "a2"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	r := &recordingReceiver{}
+	causal := NewCausalReceiver(B, r, 10, time.Minute)
+
+	// when the waiting message is redelivered
+	for _, m := range []VCMessage{captured.received[1], captured.received[1], captured.received[0]} {
+		if err := causal.Receive(m); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+
+	// then it is delivered once
+	if got, exp := len(r.received), 2; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestCausalReceiverGivesUpExpiredPredecessors(t *testing.T) {
+	// given the first message of a is lost
+	a := NewVCModel(A)
+	captured := &recordingReceiver{}
+	if err := a.SendTo(captured, "a1", "a2", "a3"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &recordingReceiver{}
+	causal := NewCausalReceiver(B, r, 10, time.Minute).WithClock(func() time.Time { return now })
+	if err := causal.Receive(captured.received[1]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// when the waiting message expires
+	now = now.Add(2 * time.Minute)
+	if got, exp := len(causal.Expire()), 1; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	if err := causal.Receive(captured.received[2]); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// then the following message does not wait for the lost one
+	if got, exp := len(r.received), 1; got != exp {
+		t.Fatalf("expected %d but got %d", exp, got)
+	}
+	if got, exp := r.received[0].newState, "a3"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+}
+
+type recordingReceiver struct {
+	received []VCMessage
+}
+
+func (r *recordingReceiver) Receive(msg VCMessage) error {
+	r.received = append(r.received, msg)
+	return nil
+}
+
+// failingReceiver rejects the given number of messages before it accepts them.
+type failingReceiver struct {
+	recordingReceiver
+	failures int
+}
+
+func (r *failingReceiver) Receive(msg VCMessage) error {
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("rejected")
+	}
+	return r.recordingReceiver.Receive(msg)
+}
+
+type multiReceiver []Receiver
+
+func (m multiReceiver) Receive(msg VCMessage) error {
+	for _, r := range m {
+		if err := r.Receive(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
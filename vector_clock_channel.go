@@ -0,0 +1,104 @@
+package messaging_spike
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrReceiverClosed = errors.New("receiver closed")
+
+// Ack is sent back for every message a ChannelReceiver delivered. It is a negative
+// acknowledgement when the receiver failed.
+type Ack struct {
+	msg VCMessage
+	err error
+}
+
+func (a Ack) Msg() VCMessage {
+	return a.msg
+}
+
+func (a Ack) Err() error {
+	return a.err
+}
+
+func (a Ack) IsNack() bool {
+	return a.err != nil
+}
+
+// ChannelReceiver is an asynchronous Receiver to wire a VCModel into goroutine based pipelines.
+// Receive only enqueues the message; Listen delivers it in another goroutine and reports the
+// result back to the sender on the acks channel.
+type ChannelReceiver struct {
+	queue     chan VCMessage
+	acks      chan<- Ack
+	mu        sync.RWMutex // held by Receive while enqueuing, so that Close waits for it
+	closed    bool
+	done      chan struct{} // closed first to release Receive calls waiting for space
+	stopped   chan struct{} // closed when no more messages are enqueued
+	closeOnce sync.Once
+}
+
+// NewChannelReceiver creates a receiver buffering up to size messages. The acks channel is
+// optional; when given it must be consumed, otherwise Listen blocks.
+func NewChannelReceiver(size int, acks chan<- Ack) *ChannelReceiver {
+	return &ChannelReceiver{
+		queue:   make(chan VCMessage, size),
+		acks:    acks,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Receive enqueues the message and blocks while the queue is full.
+func (c *ChannelReceiver) Receive(msg VCMessage) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return ErrReceiverClosed
+	}
+	select {
+	case c.queue <- msg:
+		return nil
+	case <-c.done:
+		return ErrReceiverClosed
+	}
+}
+
+// Listen delivers enqueued messages to the given receiver until closed. Every message
+// accepted by Receive is delivered.
+func (c *ChannelReceiver) Listen(r Receiver) {
+	for {
+		select {
+		case msg := <-c.queue:
+			c.deliver(r, msg)
+		case <-c.stopped:
+			for {
+				select {
+				case msg := <-c.queue:
+					c.deliver(r, msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close stops accepting messages. It returns when no Receive call enqueues anymore.
+func (c *ChannelReceiver) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		close(c.stopped)
+	})
+}
+
+func (c *ChannelReceiver) deliver(r Receiver, msg VCMessage) {
+	err := r.Receive(msg)
+	if c.acks != nil {
+		c.acks <- Ack{msg: msg, err: err}
+	}
+}
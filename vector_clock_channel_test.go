@@ -0,0 +1,110 @@
+package messaging_spike
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChannelReceiverDeliversAsynchronously(t *testing.T) {
+	// given
+	a, otherA, b := NewVCModel(A), NewVCModel(A), NewVCModel(B)
+	acks := make(chan Ack)
+	r := NewChannelReceiver(10, acks)
+	done := make(chan struct{})
+	go func() {
+		r.Listen(b)
+		close(done)
+	}()
+
+	// when
+	if err := a.SendTo(r, "v1", "v2"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := otherA.SendTo(r, "outdated"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// then
+	for _, exp := range []struct {
+		state string
+		nack  bool
+	}{{"v1", false}, {"v2", false}, {"outdated", true}} {
+		ack := <-acks
+		if got := ack.Msg().newState; got != exp.state {
+			t.Errorf("expected %q but got %q", exp.state, got)
+		}
+		if got := ack.IsNack(); got != exp.nack {
+			t.Errorf("%s: expected nack %v but got %v: %v", exp.state, exp.nack, got, ack.Err())
+		}
+	}
+	r.Close()
+	<-done
+	if got, exp := b.state, "v2"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+}
+
+func TestChannelReceiverRejectsWhenClosed(t *testing.T) {
+	// given
+	r := NewChannelReceiver(1, nil)
+	if err := NewVCModel(A).SendTo(r, "pending"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// when
+	r.Close()
+	r.Close()
+
+	// then
+	if err := NewVCModel(A).SendTo(r, "too late"); err != ErrReceiverClosed {
+		t.Errorf("expected %v but got %v", ErrReceiverClosed, err)
+	}
+	// and pending messages are still delivered
+	b := NewVCModel(B)
+	r.Listen(b)
+	if got, exp := b.state, "pending"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+}
+
+func TestChannelReceiverDeliversEveryAcceptedMessage(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		// given
+		r := NewChannelReceiver(1, nil)
+		delivered := &countingReceiver{}
+		done := make(chan struct{})
+		go func() {
+			r.Listen(delivered)
+			close(done)
+		}()
+		// when senders race with Close
+		var wg sync.WaitGroup
+		var accepted atomic.Int64
+		for s := 0; s < 4; s++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for r.Receive(VCMessage{}) == nil {
+					accepted.Add(1)
+				}
+			}()
+		}
+		r.Close()
+		wg.Wait()
+		<-done
+		// then
+		if got, exp := delivered.n.Load(), accepted.Load(); got != exp {
+			t.Fatalf("expected %d delivered but got %d", exp, got)
+		}
+	}
+}
+
+type countingReceiver struct {
+	n atomic.Int64
+}
+
+func (r *countingReceiver) Receive(VCMessage) error {
+	r.n.Add(1)
+	return nil
+}
@@ -1,10 +1,15 @@
 package messaging_spike
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
 
 type VCMessage struct {
 	vectorClock VectorClock
 	newState    string
+	seq         uint64 // number of the message among all sent by the producer; 0 when not sent by SendTo
 }
 
 // model
@@ -17,12 +22,15 @@ type VCModel struct {
 	vectorClock VectorClock
 	state       string
 	name        int
+	sent        uint64       // messages sent so far
+	Logger      *slog.Logger // silent by default
 }
 
 func NewVCModel(name int) *VCModel {
 	return &VCModel{
 		name:        name,
 		vectorClock: NewVectorClock(name),
+		Logger:      discardLogger,
 	}
 }
 
@@ -32,8 +40,9 @@ func (f *VCModel) Clock(name int) int {
 }
 
 func (f *VCModel) Receive(msg VCMessage) error {
-	fmt.Printf("Receiving %+v", msg)
+	f.log("receiving message", msg)
 	if msg.vectorClock.Before(f.vectorClock) {
+		f.log("rejecting message. state is ahead", msg)
 		return fmt.Errorf("state is ahead")
 	}
 	f.vectorClock = f.vectorClock.Inc().Merge(msg.vectorClock)
@@ -41,6 +50,16 @@ func (f *VCModel) Receive(msg VCMessage) error {
 	return nil
 }
 
+// log writes a debug message with both clocks, when enabled.
+func (f *VCModel) log(text string, msg VCMessage) {
+	l, ctx := loggerOrDiscard(f.Logger), context.Background()
+	if !l.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	l.LogAttrs(ctx, slog.LevelDebug, text, slog.Int("consumer", f.name), slog.Any("clock", f.vectorClock),
+		slog.Any("event_clock", msg.vectorClock))
+}
+
 // fail and return the first error
 func (f *VCModel) SendTo(r Receiver, msgs ...string) error {
 	if len(msgs) == 0 {
@@ -56,10 +75,12 @@ func (f *VCModel) SendTo(r Receiver, msgs ...string) error {
 
 func (f *VCModel) sendTo(r Receiver, msg string) error {
 	f.vectorClock = f.vectorClock.Inc()
-	return r.Receive(VCMessage{vectorClock: f.vectorClock, newState: msg})
+	f.sent++
+	return r.Receive(VCMessage{vectorClock: f.vectorClock, newState: msg, seq: f.sent})
 }
 
 func (f *VCModel) Reset() {
 	f.vectorClock = NewVectorClock(f.name)
 	f.state = ""
+	f.sent = 0
 }
@@ -0,0 +1,227 @@
+package messaging_spike
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+)
+
+// LinkConfig describes the faults of a simulated link from one node to another.
+type LinkConfig struct {
+	MinDelay, MaxDelay uint64  // ticks a message is in flight; random delays reorder messages
+	DropRate           float64 // probability a message is lost
+	DuplicateRate      float64 // probability a message is delivered twice
+}
+
+type link struct {
+	from, to int
+}
+
+const (
+	updateDelivery = iota
+	digestDelivery
+	stateDelivery
+)
+
+var deliveryKinds = []string{"update", "digest", "state"}
+
+type delivery struct {
+	at, seq  uint64
+	kind     int
+	from, to int
+	msg      VCMessage
+}
+
+// deliveries ordered by time and send sequence, so that the schedule is deterministic
+type deliveryQueue []delivery
+
+func (q deliveryQueue) Len() int { return len(q) }
+func (q deliveryQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q deliveryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *deliveryQueue) Push(x interface{}) { *q = append(*q, x.(delivery)) }
+func (q *deliveryQueue) Pop() interface{} {
+	old := *q
+	d := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return d
+}
+
+// Simulation runs VCModel nodes that exchange messages over simulated links which can delay,
+// reorder, duplicate, drop and partition. All randomness comes from the seeded scheduler, so a
+// failing scenario can be replayed exactly with the same seed.
+type Simulation struct {
+	rnd         *rand.Rand
+	now, seq    uint64
+	nodes       []*VCModel
+	defaultLink LinkConfig
+	links       map[link]LinkConfig
+	partitioned map[link]struct{}
+	queue       deliveryQueue
+	Trace       []string // everything that happened, for comparing replays
+	Errors      []error  // errors returned by receiving nodes
+}
+
+// NewSimulation creates nodes named 0 to n-1 connected by links with the given config.
+func NewSimulation(seed int64, n int, defaultLink LinkConfig) *Simulation {
+	s := &Simulation{
+		rnd:         rand.New(rand.NewSource(seed)),
+		defaultLink: defaultLink,
+		links:       make(map[link]LinkConfig),
+		partitioned: make(map[link]struct{}),
+	}
+	for i := 0; i < n; i++ {
+		s.nodes = append(s.nodes, NewVCModel(i))
+	}
+	return s
+}
+
+func (s *Simulation) Node(name int) *VCModel {
+	return s.nodes[name]
+}
+
+func (s *Simulation) Now() uint64 {
+	return s.now
+}
+
+// SetLink overrides the config of the link from one node to another.
+func (s *Simulation) SetLink(from, to int, c LinkConfig) {
+	s.links[link{from, to}] = c
+}
+
+// Partition splits the network into the given groups of nodes. Messages between groups are
+// dropped, including those in flight. Nodes not listed are isolated.
+func (s *Simulation) Partition(groups ...[]int) {
+	group := make(map[int]int, len(s.nodes))
+	for g, nodes := range groups {
+		for _, n := range nodes {
+			group[n] = g + 1
+		}
+	}
+	s.partitioned = make(map[link]struct{})
+	for from := range s.nodes {
+		for to := range s.nodes {
+			if from == to {
+				continue
+			}
+			if g, ok := group[from]; !ok || g != group[to] {
+				s.partitioned[link{from, to}] = struct{}{}
+			}
+		}
+	}
+	s.trace("partition %v", groups)
+}
+
+// Heal removes all partitions.
+func (s *Simulation) Heal() {
+	s.partitioned = make(map[link]struct{})
+	s.trace("heal")
+}
+
+// Send lets a node send messages to another one over the simulated link.
+func (s *Simulation) Send(from, to int, msgs ...string) error {
+	return s.nodes[from].SendTo(&simulatedLink{s: s, link: link{from, to}}, msgs...)
+}
+
+// Step delivers the next message in flight and advances the time. It returns false when
+// there is nothing to deliver.
+func (s *Simulation) Step() bool {
+	if s.queue.Len() == 0 {
+		return false
+	}
+	d := heap.Pop(&s.queue).(delivery)
+	s.now = d.at
+	l := link{d.from, d.to}
+	if _, ok := s.partitioned[l]; ok {
+		s.trace("lost %s %d->%d %q: partitioned", deliveryKinds[d.kind], d.from, d.to, d.msg.newState)
+		return true
+	}
+	node := s.nodes[d.to]
+	switch d.kind {
+	case digestDelivery:
+		push, pull := node.OnDigest(d.msg.vectorClock)
+		if push {
+			s.enqueue(link{d.to, d.from}, stateDelivery, node.replicaState())
+		}
+		if pull {
+			s.enqueue(link{d.to, d.from}, digestDelivery, VCMessage{vectorClock: node.Digest()})
+		}
+	case stateDelivery:
+		if node.OnState(d.msg) {
+			s.enqueue(link{d.to, d.from}, stateDelivery, node.replicaState())
+		}
+	default:
+		if err := node.Receive(d.msg); err != nil {
+			s.Errors = append(s.Errors, fmt.Errorf("t=%d %d->%d %q: %v", s.now, d.from, d.to, d.msg.newState, err))
+			s.trace("rejected %d->%d %q: %v", d.from, d.to, d.msg.newState, err)
+			return true
+		}
+	}
+	s.trace("delivered %s %d->%d %q", deliveryKinds[d.kind], d.from, d.to, d.msg.newState)
+	return true
+}
+
+// Run delivers all messages in flight.
+func (s *Simulation) Run() {
+	for s.Step() {
+	}
+}
+
+// RunUntil delivers all messages due up to the given time and advances the time to it.
+func (s *Simulation) RunUntil(t uint64) {
+	for s.queue.Len() > 0 && s.queue[0].at <= t {
+		s.Step()
+	}
+	if t > s.now {
+		s.now = t
+	}
+}
+
+func (s *Simulation) enqueue(l link, kind int, msg VCMessage) {
+	c, ok := s.links[l]
+	if !ok {
+		c = s.defaultLink
+	}
+	name := deliveryKinds[kind]
+	if _, ok := s.partitioned[l]; ok {
+		s.trace("lost %s %d->%d %q: partitioned", name, l.from, l.to, msg.newState)
+		return
+	}
+	if s.rnd.Float64() < c.DropRate {
+		s.trace("dropped %s %d->%d %q", name, l.from, l.to, msg.newState)
+		return
+	}
+	copies := 1
+	if s.rnd.Float64() < c.DuplicateRate {
+		copies++
+		s.trace("duplicated %s %d->%d %q", name, l.from, l.to, msg.newState)
+	}
+	for i := 0; i < copies; i++ {
+		delay := c.MinDelay
+		if c.MaxDelay > c.MinDelay {
+			delay += uint64(s.rnd.Int63n(int64(c.MaxDelay - c.MinDelay + 1)))
+		}
+		s.seq++
+		heap.Push(&s.queue, delivery{at: s.now + delay, seq: s.seq, kind: kind, from: l.from, to: l.to, msg: msg})
+	}
+	s.trace("sent %s %d->%d %q", name, l.from, l.to, msg.newState)
+}
+
+func (s *Simulation) trace(format string, args ...interface{}) {
+	s.Trace = append(s.Trace, fmt.Sprintf("t=%d ", s.now)+fmt.Sprintf(format, args...))
+}
+
+// simulatedLink is the Receiver a node sends to. Messages are delivered later by the scheduler.
+type simulatedLink struct {
+	s *Simulation
+	link
+}
+
+func (l *simulatedLink) Receive(msg VCMessage) error {
+	l.s.enqueue(l.link, updateDelivery, msg)
+	return nil
+}
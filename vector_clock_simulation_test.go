@@ -0,0 +1,132 @@
+package messaging_spike
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimulationWithReliableLinksDeliversAll(t *testing.T) {
+	// given
+	s := NewSimulation(1, 3, LinkConfig{MinDelay: 1, MaxDelay: 1})
+
+	// when
+	if err := s.Send(A, B, "a1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	s.Run()
+	if err := s.Send(B, C, "b1"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	s.Run()
+
+	// then
+	if got := s.Errors; len(got) != 0 {
+		t.Fatalf("unexpected errors %v", got)
+	}
+	if got, exp := s.Node(C).state, "b1"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := s.Node(C).Clock(A), 1; got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+	if got, exp := s.Now(), uint64(2); got != exp {
+		t.Errorf("expected %d but got %d", exp, got)
+	}
+}
+
+func TestSimulationReplaysExactlyWithSameSeed(t *testing.T) {
+	scenario := func(seed int64) *Simulation {
+		s := NewSimulation(seed, 3, LinkConfig{MinDelay: 1, MaxDelay: 10, DropRate: 0.1, DuplicateRate: 0.1})
+		for i := 0; i < 10; i++ {
+			_ = s.Send(A, C, "a")
+			_ = s.Send(B, C, "b")
+			s.RunUntil(s.Now() + 3)
+		}
+		s.Run()
+		return s
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		first, replay := scenario(seed), scenario(seed)
+		if !reflect.DeepEqual(first.Trace, replay.Trace) {
+			t.Fatalf("seed %d: expected %v but got %v", seed, first.Trace, replay.Trace)
+		}
+		if !reflect.DeepEqual(first.Node(C), replay.Node(C)) {
+			t.Errorf("seed %d: expected %+v but got %+v", seed, first.Node(C), replay.Node(C))
+		}
+	}
+}
+
+func TestSimulationReordersMessages(t *testing.T) {
+	rejected := 0
+	for seed := int64(0); seed < 20; seed++ {
+		s := NewSimulation(seed, 2, LinkConfig{MinDelay: 1, MaxDelay: 10})
+		if err := s.Send(A, B, "v1", "v2", "v3"); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		s.Run()
+		rejected += len(s.Errors)
+	}
+	if rejected == 0 {
+		t.Error("expected out of order messages to be rejected")
+	}
+}
+
+func TestSimulationDropsAndDuplicates(t *testing.T) {
+	// given
+	s := NewSimulation(1, 3, LinkConfig{})
+	s.SetLink(A, B, LinkConfig{DropRate: 1})
+	s.SetLink(A, C, LinkConfig{DuplicateRate: 1})
+
+	// when
+	if err := s.Send(A, B, "dropped"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := s.Send(A, C, "duplicated"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	s.Run()
+
+	// then
+	if got, exp := s.Node(B).state, ""; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := s.Node(C).Clock(C), 2; got != exp {
+		t.Errorf("expected %d receive ticks but got %d", exp, got)
+	}
+}
+
+func TestSimulationPartitions(t *testing.T) {
+	// given
+	s := NewSimulation(1, 3, LinkConfig{MinDelay: 5, MaxDelay: 5})
+	if err := s.Send(A, C, "in flight"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// when
+	s.Partition([]int{A, B}, []int{C})
+	if err := s.Send(A, B, "same side"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := s.Send(A, C, "other side"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	s.Run()
+
+	// then
+	if got, exp := s.Node(B).state, "same side"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+	if got, exp := s.Node(C).state, ""; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+
+	// and when healed
+	s.Heal()
+	if err := s.Send(A, C, "healed"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	s.Run()
+	if got, exp := s.Node(C).state, "healed"; got != exp {
+		t.Errorf("expected %q but got %q", exp, got)
+	}
+}
@@ -90,3 +90,18 @@ func TestWithDetachedProducer(t *testing.T) {
 		t.Errorf("expected state %q but was %q", expected, c.state)
 	}
 }
+
+func TestDescends(t *testing.T) {
+	a := NewVectorClock(A).Inc()
+	b := NewVectorClock(B).Inc().Merge(a)
+	c := NewVectorClock(C).Inc()
+	if !b.Descends(a) || a.Descends(b) {
+		t.Errorf("expected %v to descend %v", b, a)
+	}
+	if !a.Descends(a) {
+		t.Errorf("expected clock to descend itself")
+	}
+	if !b.Concurrent(c) || a.Concurrent(b) {
+		t.Errorf("expected %v concurrent to %v", b, c)
+	}
+}